@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ninjasphere/go-ninja/bus"
@@ -14,6 +15,7 @@ import (
 	"github.com/ninjasphere/go-ninja/logger"
 	"github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/go-ninja/rpc"
+	"github.com/ninjasphere/go-ninja/rpc/cbor"
 	"github.com/ninjasphere/go-ninja/rpc/json2"
 )
 
@@ -28,9 +30,18 @@ var (
 type Connection struct {
 	mqtt      bus.Bus
 	log       *logger.Logger
+	clientID  string
 	rpc       *rpc.Client
 	rpcServer *rpc.Server
 	services  []model.ServiceAnnouncement
+
+	cborMutex  sync.Mutex // protects following, which are only made if something uses cbor
+	cborRPC    *rpc.Client
+	cborServer *rpc.Server
+
+	// Given to the cbor client and server too, if they are made later. Protected by cborMutex.
+	serverInterceptors []rpc.ServerInterceptor
+	clientInterceptors []rpc.ClientInterceptor
 }
 
 // Connect Builds a new ninja connection to the MQTT broker, using the given client ID
@@ -40,6 +51,7 @@ func Connect(clientID string) (*Connection, error) {
 
 	conn := Connection{
 		log:      log,
+		clientID: clientID,
 		services: []model.ServiceAnnouncement{},
 	}
 
@@ -51,7 +63,7 @@ func Connect(clientID string) (*Connection, error) {
 
 	log.Infof("Connected")
 
-	conn.rpc = rpc.NewClient(conn.mqtt, json2.NewClientCodec())
+	conn.rpc = rpc.NewClientWithID(conn.mqtt, json2.NewClientCodec(), clientID)
 	conn.rpcServer = rpc.NewServer(conn.mqtt, json2.NewCodec())
 
 	// Add service discovery service. Responds to queries about services exposed in this process.
@@ -64,6 +76,66 @@ func Connect(clientID string) (*Connection, error) {
 	return &conn, nil
 }
 
+// rpcClient returns the rpc client for calling services with the given encoding
+func (c *Connection) rpcClient(encoding string) (*rpc.Client, error) {
+	switch encoding {
+	case "", "json":
+		return c.rpc, nil
+	case cbor.Encoding:
+		c.cborMutex.Lock()
+		defer c.cborMutex.Unlock()
+		if c.cborRPC == nil {
+			c.cborRPC = rpc.NewClientWithID(c.mqtt, cbor.NewClientCodec(), c.clientID)
+			c.cborRPC.Use(c.clientInterceptors...)
+		}
+		return c.cborRPC, nil
+	}
+	return nil, fmt.Errorf("Unknown rpc encoding '%s'", encoding)
+}
+
+// rpcServerFor returns the rpc server for exporting services with the given encoding
+func (c *Connection) rpcServerFor(encoding string) (*rpc.Server, error) {
+	switch encoding {
+	case "", "json":
+		return c.rpcServer, nil
+	case cbor.Encoding:
+		c.cborMutex.Lock()
+		defer c.cborMutex.Unlock()
+		if c.cborServer == nil {
+			c.cborServer = rpc.NewServer(c.mqtt, cbor.NewCodec())
+			c.cborServer.Use(c.serverInterceptors...)
+		}
+		return c.cborServer, nil
+	}
+	return nil, fmt.Errorf("Unknown rpc encoding '%s'", encoding)
+}
+
+// UseServerInterceptors adds interceptors to the methods of every service exported by the connection,
+// e.g. for logging, metrics or authorization. See rpc.Server.Use.
+func (c *Connection) UseServerInterceptors(interceptors ...rpc.ServerInterceptor) {
+	c.cborMutex.Lock()
+	defer c.cborMutex.Unlock()
+
+	c.serverInterceptors = append(c.serverInterceptors, interceptors...)
+	c.rpcServer.Use(interceptors...)
+	if c.cborServer != nil {
+		c.cborServer.Use(interceptors...)
+	}
+}
+
+// UseClientInterceptors adds interceptors to every call made through the connection's service clients.
+// See rpc.Client.Use.
+func (c *Connection) UseClientInterceptors(interceptors ...rpc.ClientInterceptor) {
+	c.cborMutex.Lock()
+	defer c.cborMutex.Unlock()
+
+	c.clientInterceptors = append(c.clientInterceptors, interceptors...)
+	c.rpc.Use(interceptors...)
+	if c.cborRPC != nil {
+		c.cborRPC.Use(interceptors...)
+	}
+}
+
 // GetMqttClient will be removed in a later version. All communication should happen via methods on Connection
 func (c *Connection) GetMqttClient() bus.Bus {
 	return c.mqtt
@@ -106,7 +178,7 @@ func (c *Connection) subscribe(rpc bool, topic string, callback interface{}) (*b
 	var sub *bus.Subscription
 	sub, err = c.mqtt.Subscribe(GetSubscribeTopic(topic), func(incomingTopic string, payload []byte) {
 
-		// TODO: Implement unsubscribing. For now, it will just skip over any subscriptions that have finished
+		// A message may already have been on its way to us when we cancelled
 		if finished {
 			return
 		}
@@ -120,7 +192,23 @@ func (c *Connection) subscribe(rpc bool, topic string, callback interface{}) (*b
 
 		var params json.RawMessage
 
-		if rpc {
+		if rpc && cbor.IsMessage(payload) {
+			// The callbacks take json, so cbor events are converted
+			notification, err := cbor.ReadNotification(payload)
+			if err != nil {
+				c.log.Warningf("Failed to read parameters in rpc call to %s - %v", incomingTopic, err)
+				return
+			}
+
+			jsonParams, err := json.Marshal(notification)
+			if err != nil {
+				c.log.Warningf("Failed to read parameters in rpc call to %s - %v", incomingTopic, err)
+				return
+			}
+
+			rawParams := json.RawMessage(jsonParams)
+			json2.ReadRPCParams(&rawParams, &params)
+		} else if rpc {
 			msg := &rpcMessage{}
 			err := json.Unmarshal(payload, msg)
 
@@ -146,6 +234,7 @@ func (c *Connection) subscribe(rpc bool, topic string, callback interface{}) (*b
 		if !adapter(&params, *values) {
 			// The callback has returned false, indicating that it does not want to receive any more messages,
 			// so we can cancel the subscription.
+			finished = true
 			sub.Cancel()
 		}
 
@@ -165,8 +254,9 @@ func (c *Connection) GetServiceClient(serviceTopic string) *ServiceClient {
 // GetServiceClientWithSupported returns an RPC client for the given service.
 func (c *Connection) GetServiceClientFromAnnouncement(announcement model.ServiceAnnouncement) *ServiceClient {
 	client := &ServiceClient{
-		conn:  c,
-		Topic: announcement.Topic,
+		conn:     c,
+		Topic:    announcement.Topic,
+		Encoding: announcement.Encoding,
 	}
 
 	if announcement.SupportedEvents != nil {
@@ -336,7 +426,12 @@ func (c *Connection) exportService(service interface{}, topic string, announceme
 
 	announcement.GetServiceAnnouncement().Schema = resolveSchemaURI(announcement.GetServiceAnnouncement().Schema)
 
-	exportedService, err := c.rpcServer.RegisterService(service, topic, announcement.GetServiceAnnouncement().Schema)
+	server, err := c.rpcServerFor(announcement.GetServiceAnnouncement().Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to register service on %s : %s", topic, err)
+	}
+
+	exportedService, err := server.RegisterService(service, topic, announcement.GetServiceAnnouncement().Schema)
 
 	if err != nil {
 		return nil, fmt.Errorf("Failed to register service on %s : %s", topic, err)
@@ -358,12 +453,19 @@ func (c *Connection) exportService(service interface{}, topic string, announceme
 
 	announcement.GetServiceAnnouncement().Topic = topic
 
-	// send out service announcement
-	err = exportedService.SendEvent("announce", announcement)
+	// send out service announcement. It is always json, so everyone can discover the service.
+	err = c.rpcServer.SendNotification(topic+"/event/announce", announcement)
 	if err != nil {
 		return nil, fmt.Errorf("Failed sending service announcement: %s", err)
 	}
 
+	// State events can be retained (and sent at least once) so new listeners immediately learn the current state
+	if config.Bool(false, "mqtt", "retainState") {
+		exportedService.EventOptions = map[string]*bus.PublishOptions{
+			"state": &bus.PublishOptions{QoS: bus.QoSAtLeastOnce, Retain: true},
+		}
+	}
+
 	c.log.Debugf("Exported service on topic: %s (schema: %s) with methods: %s", topic, announcement.GetServiceAnnouncement().Schema, strings.Join(*announcement.GetServiceAnnouncement().SupportedMethods, ", "))
 
 	switch service := service.(type) {
@@ -388,13 +490,18 @@ func (c *Connection) exportService(service interface{}, topic string, announceme
 
 // PublishRaw sends a simple message
 func (c *Connection) PublishRaw(topic string, payload ...interface{}) error {
+	return c.PublishRawWithOptions(topic, nil, payload...)
+}
+
+// PublishRawWithOptions sends a simple message using the given QoS and retain options
+func (c *Connection) PublishRawWithOptions(topic string, options *bus.PublishOptions, payload ...interface{}) error {
 
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("Failed to marshall mqtt message: %s", err)
 	}
 
-	c.mqtt.Publish(topic, jsonPayload)
+	c.mqtt.PublishWithOptions(topic, jsonPayload, options)
 
 	if err != nil {
 		return fmt.Errorf("Failed to write publish message to MQTT: %s", err)
@@ -1,10 +1,12 @@
 package ninja
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/ninjasphere/go-ninja/bus"
+	"github.com/ninjasphere/go-ninja/rpc"
 )
 
 type ServiceClient struct {
@@ -12,6 +14,10 @@ type ServiceClient struct {
 	Topic            string
 	SupportedEvents  []string
 	SupportedMethods []string
+	Encoding         string // How calls to the service are encoded, as in its announcement. Defaults to json.
+	// Retry, if set, retries calls that time out (or fail with one of its codes). Calls made without
+	// a timeout aren't retried, as there is no reply to wait for.
+	Retry *rpc.RetryPolicy
 }
 
 //
@@ -33,14 +39,49 @@ func (c *ServiceClient) OnEvent(event string, callback interface{}) (*bus.Subscr
 	return c.conn.Subscribe(c.Topic+"/event/"+event, callback)
 }
 
+// Call calls a method on the service. With a timeout it waits for the reply, otherwise the call is
+// asynchronous and reply must be nil. If the method failed with an rpc.CodedError, so does the call:
+// check for one with errors.As, or for a standard code with e.g. errors.Is(err, rpc.ErrOffline).
 func (c *ServiceClient) Call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	client, err := c.conn.rpcClient(c.Encoding)
+	if err != nil {
+		return err
+	}
+
 	if timeout > 0 {
-		return c.conn.rpc.CallWithTimeout(c.Topic, method, args, reply, timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		return client.CallContextWithRetry(ctx, c.Topic, method, args, reply, c.Retry)
 	}
 
 	if reply != nil {
 		return fmt.Errorf("Attempted async call to method %s on service %s with a non-nil reply", method, c.Topic)
 	}
 
-	return c.conn.rpc.Call(c.Topic, method, args)
+	return client.Call(c.Topic, method, args)
+}
+
+// CallContext calls a method on the service, waiting for the reply until the context is done (and
+// retrying it as c.Retry says). See rpc.Client.CallContext for the errors returned when it is.
+func (c *ServiceClient) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	client, err := c.conn.rpcClient(c.Encoding)
+	if err != nil {
+		return err
+	}
+
+	return client.CallContextWithRetry(ctx, c.Topic, method, args, reply, c.Retry)
+}
+
+// CallContextWithProgress calls a method on the service as CallContext does, passing the updates it
+// sends before its reply to onProgress. See rpc.Client.CallContextWithProgress.
+func (c *ServiceClient) CallContextWithProgress(ctx context.Context, method string, args interface{}, reply interface{}, onProgress func(*rpc.Progress)) error {
+	client, err := c.conn.rpcClient(c.Encoding)
+	if err != nil {
+		return err
+	}
+
+	return client.CallContextWithProgress(ctx, c.Topic, method, args, reply, onProgress)
 }
+
+var _ rpc.ServiceCaller = (*ServiceClient)(nil)
@@ -1,7 +1,9 @@
 package bus
 
 import (
+	"os"
 	"strings"
+	"sync"
 
 	"github.com/ninjasphere/go-ninja/config"
 	"github.com/ninjasphere/go-ninja/logger"
@@ -9,15 +11,60 @@ import (
 
 var log = logger.GetLogger("bus")
 
+// QoS is the MQTT quality of service level used to deliver a message
+type QoS byte
+
+const (
+	QoSAtMostOnce QoS = iota
+	QoSAtLeastOnce
+	QoSExactlyOnce
+)
+
+// PublishOptions control how a single message is delivered by the broker
+type PublishOptions struct {
+	QoS    QoS
+	Retain bool // The broker keeps the last retained message on a topic and sends it to new subscribers
+}
+
+// SubscribeOptions control how the broker delivers messages on a subscription
+type SubscribeOptions struct {
+	QoS QoS
+
+	// Messages wait in a buffer of up to BufferSize while the callback is busy, so a slow callback
+	// only holds up its own subscription. Policy decides what happens when the buffer is full.
+	// They default to mqtt.subscription.bufferSize (1000) and mqtt.subscription.policy (drop-oldest).
+	BufferSize int
+	Policy     QueuePolicy
+}
+
+// MessageProperties are the MQTT 5 request/response properties of a message
+type MessageProperties struct {
+	ResponseTopic   string `json:"responseTopic,omitempty"`   // Where the receiver should publish its response
+	CorrelationData []byte `json:"correlationData,omitempty"` // Sent back with the response, so the requester can match it to its request
+}
+
 type Bus interface {
 	Publish(topic string, payload []byte)
+	PublishWithOptions(topic string, payload []byte, options *PublishOptions)
 	Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error)
+	SubscribeWithOptions(topic string, options *SubscribeOptions, callback func(topic string, payload []byte)) (*Subscription, error)
 	OnDisconnect(cb func())
 	OnConnect(cb func())
 	Connected() bool
 	Destroy()
 }
 
+// PropertiesBus is implemented by buses that can carry MQTT 5 message properties. Check for it with a
+// type assertion, and fall back to plain topics if the bus doesn't support them.
+//
+// Only MemoryBus implements it so far. TinyBus and PahoBus speak MQTT 3.1.1, which has no properties,
+// so against a real broker everything uses the fallback.
+type PropertiesBus interface {
+	Bus
+	PublishWithProperties(topic string, payload []byte, options *PublishOptions, properties *MessageProperties)
+	SubscribeWithProperties(topic string, options *SubscribeOptions, callback func(topic string, payload []byte, properties *MessageProperties)) (*Subscription, error)
+}
+
 func MustConnect(host, id string) Bus {
 	//return ConnectTinyBus(host, id)
 
@@ -31,26 +78,198 @@ func MustConnect(host, id string) Bus {
 	switch library {
 	case "tiny":
 		bus, err = ConnectTinyBus(host, id)
+	case "paho":
+		bus, err = ConnectPahoBus(host, id)
+	case "memory":
+		bus, err = ConnectMemoryBus(host, id)
 	default:
 		log.Fatalf("Unknown mqtt bus implementation: %s", library)
 	}
 
 	if err != nil {
 		log.HandleError(err, "Failed to connect to mqtt")
+		return bus
+	}
+
+	if file := config.String("", "mqtt", "record"); file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.FatalError(err, "Failed to open mqtt recording "+file)
+		}
+		log.Infof("Recording mqtt traffic to %s", file)
+		bus = NewRecordingBus(bus, NewJSONLinesRecorder(f))
 	}
+
 	return bus
 }
 
 type message struct {
-	topic   string
-	payload []byte
+	topic      string
+	payload    []byte
+	properties *MessageProperties
 }
 
 type Subscription struct {
-	topic     string
-	c         chan *message
-	Cancel    func()
+	topic  string
+	qos    QoS
+	size   int
+	policy QueuePolicy
+
+	mutex     sync.Mutex // protects following
+	changed   *sync.Cond // Signalled when a message is buffered or taken, or the subscription is cancelled
+	buffer    []*message
+	full      bool
 	cancelled bool
+	stats     SubscriptionStats
+
+	Cancel func()
+}
+
+// SubscriptionStats are the counters kept by a subscription's buffer
+type SubscriptionStats struct {
+	Queued    uint64 // Messages that were buffered for the callback
+	Dropped   uint64 // Messages discarded because the buffer was full
+	Delivered uint64 // Messages the callback has finished handling
+	Length    int    // Messages currently waiting for the callback
+}
+
+// newSubscription creates a subscription whose callback is called from its own goroutine until it is cancelled
+func newSubscription(topic string, options *SubscribeOptions, callback func(topic string, payload []byte, properties *MessageProperties)) *Subscription {
+	if options == nil {
+		options = &SubscribeOptions{}
+	}
+
+	size := options.BufferSize
+	if size <= 0 {
+		size = config.Int(1000, "mqtt", "subscription", "bufferSize")
+	}
+
+	policy := options.Policy
+	if policy == "" {
+		policy = QueuePolicy(config.String(string(DropOldest), "mqtt", "subscription", "policy"))
+	}
+
+	switch policy {
+	case DropOldest, DropNewest, Block:
+	default:
+		log.Warningf("Unknown subscription buffer policy '%s', using %s", policy, DropOldest)
+		policy = DropOldest
+	}
+
+	subscription := &Subscription{
+		topic:  topic,
+		qos:    options.QoS,
+		size:   size,
+		policy: policy,
+	}
+	subscription.changed = sync.NewCond(&subscription.mutex)
+
+	go func() {
+		for {
+			m, ok := subscription.next()
+			if !ok {
+				return
+			}
+			callback(m.topic, m.payload, m.properties)
+
+			subscription.mutex.Lock()
+			subscription.stats.Delivered++
+			subscription.mutex.Unlock()
+		}
+	}()
+
+	return subscription
+}
+
+// withoutProperties adapts a callback that doesn't care about message properties
+func withoutProperties(callback func(topic string, payload []byte)) func(topic string, payload []byte, properties *MessageProperties) {
+	return func(topic string, payload []byte, properties *MessageProperties) {
+		callback(topic, payload)
+	}
+}
+
+// next waits for the next buffered message. It returns false once the subscription is cancelled.
+func (s *Subscription) next() (*message, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.buffer) == 0 && !s.cancelled {
+		s.changed.Wait()
+	}
+	if s.cancelled {
+		return nil, false
+	}
+
+	m := s.buffer[0]
+	s.buffer = s.buffer[1:]
+	if len(s.buffer) == 0 {
+		s.full = false
+	}
+	s.changed.Broadcast()
+	return m, true
+}
+
+// deliver buffers a message for the subscription's callback, unless the subscription has been cancelled.
+// It only blocks if the buffer is full and the policy is Block.
+func (s *Subscription) deliver(m *message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.buffer) >= s.size && !s.cancelled {
+		s.warnFull()
+
+		switch s.policy {
+		case DropNewest:
+			s.stats.Dropped++
+			return
+		case DropOldest:
+			s.buffer = s.buffer[1:]
+			s.stats.Dropped++
+		default:
+			s.changed.Wait()
+		}
+	}
+
+	if s.cancelled {
+		return
+	}
+
+	s.buffer = append(s.buffer, m)
+	s.stats.Queued++
+	s.changed.Broadcast()
+}
+
+// warnFull logs the first time the buffer fills up since it was last empty. s.mutex must be held.
+func (s *Subscription) warnFull() {
+	if !s.full {
+		s.full = true
+		log.Warningf("Subscription to %s can't keep up, its buffer is full (%d messages). Policy: %s", s.topic, s.size, s.policy)
+	}
+}
+
+// cancel stops the subscription's goroutine, discarding anything still buffered. It returns false if
+// it had already been cancelled.
+func (s *Subscription) cancel() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cancelled {
+		return false
+	}
+	s.cancelled = true
+	s.buffer = nil
+	s.changed.Broadcast()
+	return true
+}
+
+// Stats returns the counters of the subscription's buffer, for monitoring
+func (s *Subscription) Stats() SubscriptionStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := s.stats
+	stats.Length = len(s.buffer)
+	return stats
 }
 
 func matches(subscription string, topic string) bool {
@@ -85,7 +304,10 @@ func matches(subscription string, topic string) bool {
 	return false
 }
 
+// baseBus holds the connection state and handlers shared by the Bus implementations. It is safe
+// to use from multiple goroutines.
 type baseBus struct {
+	stateMutex         sync.Mutex // protects following
 	destroyed          bool
 	connectionStatus   bool
 	disconnectHandlers []func()
@@ -93,21 +315,40 @@ type baseBus struct {
 }
 
 func (b *baseBus) OnDisconnect(cb func()) {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
 	b.disconnectHandlers = append(b.disconnectHandlers, cb)
 }
 
 func (b *baseBus) OnConnect(cb func()) {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
 	b.connectHandlers = append(b.connectHandlers, cb)
 }
 
 func (b *baseBus) Connected() bool {
-	if b.destroyed {
-		return false
-	}
-	return b.connectionStatus
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+	return !b.destroyed && b.connectionStatus
+}
+
+// destroy marks the bus as destroyed. No more connect or disconnect handlers will be called.
+func (b *baseBus) destroy() {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+	b.destroyed = true
+}
+
+func (b *baseBus) isDestroyed() bool {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+	return b.destroyed
 }
 
 func (b *baseBus) disconnected() {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+
 	if b.destroyed {
 		return
 	}
@@ -118,6 +359,9 @@ func (b *baseBus) disconnected() {
 }
 
 func (b *baseBus) connected() {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+
 	if b.destroyed {
 		return
 	}
@@ -1,6 +1,7 @@
 package bus
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -28,3 +29,53 @@ func TestSimplePubSub(t *testing.T) {
 	}
 
 }
+
+func TestSubscriptionBufferPolicies(t *testing.T) {
+	for _, policy := range []QueuePolicy{DropOldest, DropNewest} {
+		release := make(chan bool)
+		received := make(chan string, 10)
+
+		sub := newSubscription("test", &SubscribeOptions{BufferSize: 2, Policy: policy}, withoutProperties(func(topic string, payload []byte) {
+			<-release
+			received <- string(payload)
+		}))
+
+		sub.deliver(&message{topic: "test", payload: []byte("0")})
+
+		// Wait until the callback is stuck on the first message, so the rest are buffered
+		for sub.Stats().Length > 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		for _, payload := range []string{"1", "2", "3"} {
+			sub.deliver(&message{topic: "test", payload: []byte(payload)})
+		}
+
+		stats := sub.Stats()
+		if stats.Dropped != 1 || stats.Length != 2 {
+			t.Errorf("%s: expected one dropped and two buffered, got %+v", policy, stats)
+		}
+
+		close(release)
+
+		var got []string
+		for i := 0; i < 3; i++ {
+			select {
+			case payload := <-received:
+				got = append(got, payload)
+			case <-time.After(time.Second):
+				t.Fatalf("%s: timed out waiting for messages, got %v", policy, got)
+			}
+		}
+
+		expected := "[0 2 3]"
+		if policy == DropNewest {
+			expected = "[0 1 2]"
+		}
+		if fmt.Sprintf("%v", got) != expected {
+			t.Errorf("%s: expected %s, got %v", policy, expected, got)
+		}
+
+		sub.cancel()
+	}
+}
@@ -0,0 +1,228 @@
+package bus
+
+import "sync"
+
+// memoryBroker routes messages between all the MemoryBus instances that were
+// connected using the same host.
+type memoryBroker struct {
+	sync.Mutex
+	clients  []*MemoryBus
+	retained map[string]*message
+}
+
+var (
+	memoryBrokersMutex sync.Mutex
+	memoryBrokers      = make(map[string]*memoryBroker)
+)
+
+func getMemoryBroker(host string) *memoryBroker {
+	memoryBrokersMutex.Lock()
+	defer memoryBrokersMutex.Unlock()
+
+	broker, ok := memoryBrokers[host]
+	if !ok {
+		broker = &memoryBroker{
+			retained: make(map[string]*message),
+		}
+		memoryBrokers[host] = broker
+	}
+	return broker
+}
+
+func (m *memoryBroker) add(b *MemoryBus) {
+	m.Lock()
+	m.clients = append(m.clients, b)
+	m.Unlock()
+}
+
+func (m *memoryBroker) remove(b *MemoryBus) {
+	m.Lock()
+	defer m.Unlock()
+	for i, c := range m.clients {
+		if c == b {
+			m.clients = append(m.clients[:i], m.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *memoryBroker) publish(msg *message, retain bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if retain {
+		// As with a real broker, an empty retained message clears the retained value
+		if len(msg.payload) == 0 {
+			delete(m.retained, msg.topic)
+		} else {
+			m.retained[msg.topic] = msg
+		}
+	}
+
+	for _, c := range m.clients {
+		c.enqueue(msg, nil)
+	}
+}
+
+// subscribe registers a subscription with its bus, and queues any retained messages that match it.
+func (m *memoryBroker) subscribe(b *MemoryBus, subscription *Subscription) {
+	m.Lock()
+	defer m.Unlock()
+
+	b.mutex.Lock()
+	b.subscriptions = append(b.subscriptions, subscription)
+	b.mutex.Unlock()
+
+	for topic, msg := range m.retained {
+		if matches(subscription.topic, topic) {
+			b.enqueue(msg, subscription)
+		}
+	}
+}
+
+// MemoryBus is a Bus that never leaves the process. Every MemoryBus connected with the same
+// host shares a broker, so a driver and the app or test talking to it can be wired together
+// without a real MQTT server. Select it with mqtt.implementation = "memory".
+// It carries MQTT 5 message properties, so it is also a PropertiesBus.
+type MemoryBus struct {
+	baseBus
+	broker        *memoryBroker
+	id            string
+	mutex         sync.Mutex // protects following
+	subscriptions []*Subscription
+	queue         []*delivery
+	wake          *sync.Cond
+}
+
+// delivery is a message waiting to be handed to the subscriptions that matched it when it was published.
+type delivery struct {
+	message       *message
+	subscriptions []*Subscription
+}
+
+func ConnectMemoryBus(host, id string) (*MemoryBus, error) {
+
+	bus := &MemoryBus{
+		broker:        getMemoryBroker(host),
+		id:            id,
+		subscriptions: make([]*Subscription, 0),
+	}
+	bus.wake = sync.NewCond(&bus.mutex)
+
+	go bus.deliver()
+
+	bus.broker.add(bus)
+	bus.connected()
+
+	return bus, nil
+}
+
+// enqueue queues a message for either a single subscription, or all our matching subscriptions.
+// It never blocks, so a subscriber may safely publish from inside its own callback.
+func (b *MemoryBus) enqueue(msg *message, subscription *Subscription) {
+	b.mutex.Lock()
+
+	var subscriptions []*Subscription
+	if subscription != nil {
+		subscriptions = []*Subscription{subscription}
+	} else {
+		for _, sub := range b.subscriptions {
+			if matches(sub.topic, msg.topic) {
+				subscriptions = append(subscriptions, sub)
+			}
+		}
+	}
+
+	if len(subscriptions) > 0 {
+		b.queue = append(b.queue, &delivery{msg, subscriptions})
+	}
+	b.mutex.Unlock()
+	b.wake.Signal()
+}
+
+func (b *MemoryBus) deliver() {
+	for {
+		b.mutex.Lock()
+		for len(b.queue) == 0 && !b.isDestroyed() {
+			b.wake.Wait()
+		}
+		if b.isDestroyed() {
+			b.mutex.Unlock()
+			return
+		}
+		next := b.queue[0]
+		b.queue = b.queue[1:]
+		b.mutex.Unlock()
+
+		for _, sub := range next.subscriptions {
+			sub.deliver(next.message)
+		}
+	}
+}
+
+func (b *MemoryBus) Destroy() {
+	log.Infof("Destroy called")
+	b.broker.remove(b)
+
+	b.destroy()
+
+	// Taking the lock ensures deliver() is either waiting, or yet to check isDestroyed()
+	b.mutex.Lock()
+	b.wake.Signal()
+	subscriptions := append([]*Subscription{}, b.subscriptions...)
+	b.mutex.Unlock()
+
+	// Stops the subscriptions' delivery goroutines
+	for _, subscription := range subscriptions {
+		subscription.Cancel()
+	}
+}
+
+func (b *MemoryBus) Publish(topic string, payload []byte) {
+	b.PublishWithOptions(topic, payload, nil)
+}
+
+// PublishWithOptions publishes a message. Every message is delivered exactly once in memory, so only
+// the Retain option has any effect.
+func (b *MemoryBus) PublishWithOptions(topic string, payload []byte, options *PublishOptions) {
+	b.PublishWithProperties(topic, payload, options, nil)
+}
+
+// PublishWithProperties publishes a message with MQTT 5 properties, which subscribers using
+// SubscribeWithProperties receive along with it
+func (b *MemoryBus) PublishWithProperties(topic string, payload []byte, options *PublishOptions, properties *MessageProperties) {
+	b.broker.publish(&message{topic, payload, properties}, options != nil && options.Retain)
+}
+
+func (b *MemoryBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.SubscribeWithOptions(topic, nil, callback)
+}
+
+func (b *MemoryBus) SubscribeWithOptions(topic string, options *SubscribeOptions, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.SubscribeWithProperties(topic, options, withoutProperties(callback))
+}
+
+func (b *MemoryBus) SubscribeWithProperties(topic string, options *SubscribeOptions, callback func(topic string, payload []byte, properties *MessageProperties)) (*Subscription, error) {
+
+	subscription := newSubscription(topic, options, callback)
+
+	subscription.Cancel = func() {
+		if !subscription.cancel() {
+			return
+		}
+
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		for i, s := range b.subscriptions {
+			if s == subscription {
+				b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+				break
+			}
+		}
+	}
+
+	b.broker.subscribe(b, subscription)
+
+	return subscription, nil
+}
@@ -0,0 +1,132 @@
+package bus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBusPubSub(t *testing.T) {
+
+	publisher, _ := ConnectMemoryBus("TestMemoryBusPubSub", "publisher")
+	subscriber, _ := ConnectMemoryBus("TestMemoryBusPubSub", "subscriber")
+	defer publisher.Destroy()
+	defer subscriber.Destroy()
+
+	received := make(chan string, 10)
+
+	subscriber.Subscribe("$device/+/channel/#", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+
+	publisher.Publish("$device/123/event/state", []byte("ignored"))
+	publisher.Publish("$device/123/channel/light/event/state", []byte("true"))
+
+	select {
+	case msg := <-received:
+		if msg != "$device/123/channel/light/event/state true" {
+			t.Errorf("Unexpected message: %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+
+	select {
+	case msg := <-received:
+		t.Errorf("Unexpected message: %s", msg)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestMemoryBusPublishFromCallback(t *testing.T) {
+
+	bus, _ := ConnectMemoryBus("TestMemoryBusPublishFromCallback", "test")
+	defer bus.Destroy()
+
+	done := make(chan bool)
+
+	bus.Subscribe("request", func(topic string, payload []byte) {
+		bus.Publish("request/reply", payload)
+	})
+	bus.Subscribe("request/reply", func(topic string, payload []byte) {
+		done <- string(payload) == "hello"
+	})
+
+	bus.Publish("request", []byte("hello"))
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Errorf("Wrong reply payload")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for reply")
+	}
+}
+
+func TestMemoryBusCancel(t *testing.T) {
+
+	bus, _ := ConnectMemoryBus("TestMemoryBusCancel", "test")
+	defer bus.Destroy()
+
+	received := make(chan bool, 10)
+
+	sub, _ := bus.Subscribe("topic", func(topic string, payload []byte) {
+		received <- true
+	})
+	sub.Cancel()
+
+	bus.Publish("topic", []byte("hello"))
+
+	select {
+	case <-received:
+		t.Errorf("Cancelled subscription received a message")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestMemoryBusRetained(t *testing.T) {
+
+	bus, _ := ConnectMemoryBus("TestMemoryBusRetained", "test")
+	defer bus.Destroy()
+
+	bus.PublishWithOptions("$device/1/event/state", []byte("old"), &PublishOptions{Retain: true})
+	bus.PublishWithOptions("$device/1/event/state", []byte("current"), &PublishOptions{Retain: true})
+	bus.PublishWithOptions("$device/2/event/state", []byte("cleared"), &PublishOptions{Retain: true})
+	bus.PublishWithOptions("$device/2/event/state", []byte{}, &PublishOptions{Retain: true})
+	bus.Publish("$device/3/event/state", []byte("not retained"))
+
+	received := make(chan string, 10)
+
+	bus.Subscribe("$device/+/event/state", func(topic string, payload []byte) {
+		received <- string(payload)
+	})
+
+	select {
+	case msg := <-received:
+		if msg != "current" {
+			t.Errorf("Expected the latest retained message, got: %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for retained message")
+	}
+
+	select {
+	case msg := <-received:
+		t.Errorf("Unexpected message: %s", msg)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestMemoryBusDestroyCancelsSubscriptions(t *testing.T) {
+
+	bus, _ := ConnectMemoryBus("TestMemoryBusDestroyCancelsSubscriptions", "test")
+
+	subscription, _ := bus.Subscribe("topic", func(topic string, payload []byte) {})
+	bus.Destroy()
+
+	subscription.mutex.Lock()
+	defer subscription.mutex.Unlock()
+	if !subscription.cancelled {
+		t.Errorf("Expected Destroy to cancel the subscription")
+	}
+}
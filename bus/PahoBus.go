@@ -0,0 +1,267 @@
+package bus
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	proto "github.com/huin/mqtt"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// PahoBus is a Bus built on the Eclipse Paho MQTT client. Select it with mqtt.implementation = "paho".
+// It uses the same mqtt.* config keys as TinyBus, and reconnects and resubscribes in the same way.
+// Like TinyBus it speaks MQTT 3.1.1, so it isn't a PropertiesBus.
+type PahoBus struct {
+	baseBus
+	client         paho.Client
+	mutex          sync.Mutex // protects subscriptions
+	subscriptions  []*Subscription
+	filters        filterLocks
+	queue          *publishQueue
+	connectTimeout time.Duration
+	ready          chan struct{} // Closed once the first onConnect has finished
+	readyOnce      sync.Once
+	id             string
+}
+
+func ConnectPahoBus(host, id string) (*PahoBus, error) {
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	bus := &PahoBus{
+		subscriptions:  make([]*Subscription, 0),
+		queue:          newPublishQueue(config.Int(1000, "mqtt", "queue", "size"), QueuePolicy(config.String(string(DropOldest), "mqtt", "queue", "policy"))),
+		connectTimeout: config.Duration(time.Second*10, "mqtt", "connectTimeout"),
+		ready:          make(chan struct{}),
+		id:             id,
+	}
+
+	scheme := "tcp"
+	if tlsConfig != nil {
+		scheme = "ssl"
+	}
+
+	options := paho.NewClientOptions().
+		AddBroker(fmt.Sprintf("%s://%s", scheme, host)).
+		SetClientID(id).
+		SetTLSConfig(tlsConfig).
+		SetUsername(config.String("", "mqtt", "username")).
+		SetPassword(config.String("", "mqtt", "password")).
+		SetCleanSession(true).
+		SetWill(fmt.Sprintf("$node/%s/module/%s/state/connected", config.Serial(), id), "false", 0, true).
+		SetKeepAlive(config.Duration(time.Second*30, "mqtt", "keepAlive")).
+		SetPingTimeout(config.Duration(time.Second*10, "mqtt", "pingTimeout")).
+		SetConnectTimeout(bus.connectTimeout).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(config.Duration(time.Millisecond*500, "mqtt", "backoff", "initial")).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(config.Duration(time.Second*30, "mqtt", "backoff", "max")).
+		SetDefaultPublishHandler(bus.onIncoming).
+		SetOnConnectHandler(bus.onConnect).
+		SetConnectionLostHandler(bus.onConnectionLost)
+
+	bus.client = paho.NewClient(options)
+
+	// With ConnectRetry, this only completes once we are connected (or destroyed)
+	token := bus.client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+
+	// paho calls onConnect in the background. Wait for it, so our first subscriptions don't race
+	// its resubscribing.
+	<-bus.ready
+
+	return bus, nil
+}
+
+// onConnect is called by paho each time it (re)connects. We use a clean session, so the server has
+// forgotten our subscriptions.
+func (b *PahoBus) onConnect(client paho.Client) {
+	log.Infof("Connected to mqtt server")
+
+	b.connected()
+
+	for topic := range b.subscribedTopics() {
+		unlock := b.filters.lock(topic)
+		// It may have been cancelled since, and the server told about it
+		if qos, ok := b.subscribedTopics()[topic]; ok {
+			if err := b.subscribe(topic, qos); err != nil {
+				log.Warningf("Failed to resubscribe: %s", err)
+			}
+		}
+		unlock()
+	}
+
+	client.Publish(fmt.Sprintf("node/%s/module/%s/state/connected", config.Serial(), b.id), 0, true, []byte("true"))
+
+	// Send everything that was published while we were disconnected
+	b.queue.flush(b.send)
+
+	b.readyOnce.Do(func() {
+		close(b.ready)
+	})
+}
+
+func (b *PahoBus) onConnectionLost(client paho.Client, err error) {
+	log.Warningf("Lost connection to mqtt server: %s", err)
+	b.queue.offline()
+	b.disconnected()
+}
+
+func (b *PahoBus) onIncoming(client paho.Client, msg paho.Message) {
+
+	b.mutex.Lock()
+	subscriptions := make([]*Subscription, len(b.subscriptions))
+	copy(subscriptions, b.subscriptions)
+	b.mutex.Unlock()
+
+	for _, sub := range subscriptions {
+		if matches(sub.topic, msg.Topic()) {
+			sub.deliver(&message{topic: msg.Topic(), payload: msg.Payload()})
+		}
+	}
+}
+
+func (b *PahoBus) Destroy() {
+	log.Infof("Destroy called")
+	b.destroy()
+	b.client.Disconnect(250)
+}
+
+func (b *PahoBus) Publish(topic string, payload []byte) {
+	b.PublishWithOptions(topic, payload, nil)
+}
+
+// PublishWithOptions publishes a message. While we are disconnected it is held in the offline
+// queue (configured with mqtt.queue.size and mqtt.queue.policy) and sent once we reconnect.
+func (b *PahoBus) PublishWithOptions(topic string, payload []byte, options *PublishOptions) {
+	if options == nil {
+		options = &PublishOptions{}
+	}
+
+	b.queue.publish(&proto.Publish{
+		Header: proto.Header{
+			QosLevel: proto.QosLevel(options.QoS),
+			Retain:   options.Retain,
+		},
+		TopicName: topic,
+		Payload:   proto.BytesPayload(payload),
+	}, b.send)
+}
+
+// QueueStats returns the counters of the offline publish queue, for monitoring
+func (b *PahoBus) QueueStats() QueueStats {
+	return b.queue.Stats()
+}
+
+// send hands a message to paho. QoS 1 and 2 messages are then paho's responsibility until acknowledged,
+// so we only wait to see QoS 0 messages written.
+func (b *PahoBus) send(msg *proto.Publish) error {
+	token := b.client.Publish(msg.TopicName, byte(msg.QosLevel), msg.Retain, []byte(msg.Payload.(proto.BytesPayload)))
+	if msg.QosLevel == proto.QosAtMostOnce {
+		token.WaitTimeout(b.connectTimeout)
+	}
+	return token.Error()
+}
+
+func (b *PahoBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.SubscribeWithOptions(topic, nil, callback)
+}
+
+func (b *PahoBus) SubscribeWithOptions(topic string, options *SubscribeOptions, callback func(topic string, payload []byte)) (*Subscription, error) {
+
+	subscription := newSubscription(topic, options, withoutProperties(callback))
+
+	subscription.Cancel = func() {
+		if !subscription.cancel() {
+			return
+		}
+
+		unlock := b.filters.lock(topic)
+		defer unlock()
+
+		// Only unsubscribe from the server if nobody else here is still listening
+		if b.remove(subscription) && b.Connected() {
+			token := b.client.Unsubscribe(topic)
+			if token.WaitTimeout(b.connectTimeout) && token.Error() != nil {
+				log.Warningf("Failed to unsubscribe from %s: %s", topic, token.Error())
+			}
+		}
+	}
+
+	unlock := b.filters.lock(topic)
+	defer unlock()
+
+	b.mutex.Lock()
+	b.subscriptions = append(b.subscriptions, subscription)
+	b.mutex.Unlock()
+
+	// If someone here is already listening at a higher QoS, we mustn't downgrade them
+	err := b.subscribe(topic, b.subscribedTopics()[topic])
+	if err != nil {
+		// The server refused it, so there is nothing to unsubscribe from
+		subscription.cancel()
+		b.remove(subscription)
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+// remove drops a subscription, returning true if it was the last one for its topic filter
+func (b *PahoBus) remove(subscription *Subscription) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i, s := range b.subscriptions {
+		if s == subscription {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			break
+		}
+	}
+
+	for _, s := range b.subscriptions {
+		if s.topic == subscription.topic {
+			return false
+		}
+	}
+	return true
+}
+
+// subscribedTopics returns each topic filter we have a subscription for, with the highest QoS any of
+// its subscriptions asked for
+func (b *PahoBus) subscribedTopics() map[string]QoS {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	topics := make(map[string]QoS)
+	for _, s := range b.subscriptions {
+		if qos, ok := topics[s.topic]; !ok || s.qos > qos {
+			topics[s.topic] = s.qos
+		}
+	}
+	return topics
+}
+
+// subscribe asks the server for messages on a topic filter. Incoming messages all go to onIncoming,
+// which hands them to our matching subscriptions.
+func (b *PahoBus) subscribe(topic string, qos QoS) error {
+	token := b.client.Subscribe(topic, byte(qos), nil)
+	if !token.WaitTimeout(b.connectTimeout) || token.Error() != nil {
+		// We've lost the connection, we will subscribe again once we reconnect.
+		log.Warningf("Failed to subscribe to %s: %v", topic, token.Error())
+		return nil
+	}
+
+	if token.(*paho.SubscribeToken).Result()[topic] == byte(subscriptionRefused) {
+		return fmt.Errorf("Subscription to %s was refused by the mqtt server", topic)
+	}
+	return nil
+}
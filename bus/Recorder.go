@@ -0,0 +1,355 @@
+package bus
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Direction says whether a recorded message was sent or received by the module
+type Direction string
+
+const (
+	Outgoing Direction = "out"
+	Incoming Direction = "in"
+)
+
+// Record is a single message seen by a RecordingBus
+type Record struct {
+	Time         time.Time
+	Direction    Direction
+	Topic        string
+	Subscription string // The topic filter an incoming message was delivered to
+	QoS          QoS
+	Retain       bool
+	Properties   *MessageProperties // Only recorded on buses that carry them
+	Payload      []byte
+}
+
+// jsonRecord is how a Record is written to a recording. Text payloads (nearly all of ours are JSON)
+// are written as a string, so recordings can be read and grepped and are replayed byte for byte,
+// anything else is base64 encoded. Older recordings embedded JSON payloads as-is, in Payload.
+type jsonRecord struct {
+	Time         time.Time          `json:"time"`
+	Direction    Direction          `json:"direction"`
+	Topic        string             `json:"topic"`
+	Subscription string             `json:"subscription,omitempty"`
+	QoS          QoS                `json:"qos,omitempty"`
+	Retain       bool               `json:"retain,omitempty"`
+	Properties   *MessageProperties `json:"properties,omitempty"`
+	Text         *string            `json:"text,omitempty"`
+	Payload      json.RawMessage    `json:"payload,omitempty"`
+	Binary       []byte             `json:"binary,omitempty"`
+}
+
+func (r *Record) MarshalJSON() ([]byte, error) {
+	j := jsonRecord{
+		Time:         r.Time,
+		Direction:    r.Direction,
+		Topic:        r.Topic,
+		Subscription: r.Subscription,
+		QoS:          r.QoS,
+		Retain:       r.Retain,
+		Properties:   r.Properties,
+	}
+
+	if utf8.Valid(r.Payload) {
+		text := string(r.Payload)
+		j.Text = &text
+	} else {
+		j.Binary = r.Payload
+	}
+
+	return json.Marshal(j)
+}
+
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var j jsonRecord
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	*r = Record{
+		Time:         j.Time,
+		Direction:    j.Direction,
+		Topic:        j.Topic,
+		Subscription: j.Subscription,
+		QoS:          j.QoS,
+		Retain:       j.Retain,
+		Properties:   j.Properties,
+		Payload:      j.Binary,
+	}
+	if j.Text != nil {
+		r.Payload = []byte(*j.Text)
+	} else if j.Payload != nil {
+		r.Payload = []byte(j.Payload)
+	}
+	return nil
+}
+
+// A Recorder stores the records of a RecordingBus. It must be safe to call from multiple goroutines.
+type Recorder interface {
+	Record(record *Record)
+}
+
+// JSONLinesRecorder writes each record as a line of JSON
+type JSONLinesRecorder struct {
+	mutex  sync.Mutex // protects following
+	w      io.Writer
+	failed bool
+}
+
+func NewJSONLinesRecorder(w io.Writer) *JSONLinesRecorder {
+	return &JSONLinesRecorder{w: w}
+}
+
+func (r *JSONLinesRecorder) Record(record *Record) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Warningf("Failed to encode bus record for %s: %s", record.Topic, err)
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, err := r.w.Write(append(line, '\n')); err != nil && !r.failed {
+		// Only complain once, or we'd fill the log with the same error for every message
+		r.failed = true
+		log.Warningf("Failed to write bus recording: %s", err)
+	}
+}
+
+// RingBuffer keeps the most recent records in memory, for tests or for dumping when something goes wrong
+type RingBuffer struct {
+	mutex   sync.Mutex // protects following
+	records []*Record
+	next    int
+	full    bool
+}
+
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{records: make([]*Record, size)}
+}
+
+func (r *RingBuffer) Record(record *Record) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.records) == 0 {
+		return
+	}
+
+	r.records[r.next] = record
+	r.next = (r.next + 1) % len(r.records)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Records returns the records in the buffer, oldest first
+func (r *RingBuffer) Records() []*Record {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.full {
+		return append([]*Record{}, r.records[:r.next]...)
+	}
+	return append(append([]*Record{}, r.records[r.next:]...), r.records[:r.next]...)
+}
+
+// WriteTo writes the records in the buffer as JSON lines, so they can be replayed later
+func (r *RingBuffer) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for _, record := range r.Records() {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return n, err
+		}
+		written, err := w.Write(append(line, '\n'))
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// RecordingBus wraps a Bus, recording every message published through it and every message delivered
+// to its subscriptions. A message delivered to several subscriptions is recorded once for each, with the
+// topic filter it was delivered to.
+// Set mqtt.record to a file name to have MustConnect record to that file.
+type RecordingBus struct {
+	Bus
+	recorder Recorder
+}
+
+// NewRecordingBus wraps a bus to record its messages. If the bus is a PropertiesBus, so is the returned
+// bus, and the messages' properties are recorded along with them.
+func NewRecordingBus(bus Bus, recorder Recorder) Bus {
+	recording := &RecordingBus{bus, recorder}
+	if properties, ok := bus.(PropertiesBus); ok {
+		return &propertiesRecordingBus{recording, properties}
+	}
+	return recording
+}
+
+func (b *RecordingBus) Publish(topic string, payload []byte) {
+	b.PublishWithOptions(topic, payload, nil)
+}
+
+func (b *RecordingBus) PublishWithOptions(topic string, payload []byte, options *PublishOptions) {
+	b.recordOutgoing(topic, payload, options, nil)
+	b.Bus.PublishWithOptions(topic, payload, options)
+}
+
+func (b *RecordingBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.SubscribeWithOptions(topic, nil, callback)
+}
+
+func (b *RecordingBus) SubscribeWithOptions(filter string, options *SubscribeOptions, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.Bus.SubscribeWithOptions(filter, options, func(topic string, payload []byte) {
+		b.recordIncoming(filter, topic, payload, nil)
+		callback(topic, payload)
+	})
+}
+
+func (b *RecordingBus) recordOutgoing(topic string, payload []byte, options *PublishOptions, properties *MessageProperties) {
+	record := &Record{
+		Time:       time.Now(),
+		Direction:  Outgoing,
+		Topic:      topic,
+		Properties: properties,
+		Payload:    payload,
+	}
+	if options != nil {
+		record.QoS = options.QoS
+		record.Retain = options.Retain
+	}
+	b.recorder.Record(record)
+}
+
+func (b *RecordingBus) recordIncoming(filter string, topic string, payload []byte, properties *MessageProperties) {
+	b.recorder.Record(&Record{
+		Time:         time.Now(),
+		Direction:    Incoming,
+		Topic:        topic,
+		Subscription: filter,
+		Properties:   properties,
+		Payload:      payload,
+	})
+}
+
+// propertiesRecordingBus is a RecordingBus around a PropertiesBus. It is only used for those, so that
+// wrapping a bus doesn't change whether it looks like it can carry properties.
+type propertiesRecordingBus struct {
+	*RecordingBus
+	bus PropertiesBus
+}
+
+func (b *propertiesRecordingBus) PublishWithProperties(topic string, payload []byte, options *PublishOptions, properties *MessageProperties) {
+	b.recordOutgoing(topic, payload, options, properties)
+	b.bus.PublishWithProperties(topic, payload, options, properties)
+}
+
+func (b *propertiesRecordingBus) SubscribeWithProperties(filter string, options *SubscribeOptions, callback func(topic string, payload []byte, properties *MessageProperties)) (*Subscription, error) {
+	return b.bus.SubscribeWithProperties(filter, options, func(topic string, payload []byte, properties *MessageProperties) {
+		b.recordIncoming(filter, topic, payload, properties)
+		callback(topic, payload, properties)
+	})
+}
+
+// ReadRecording reads the records written by a JSONLinesRecorder
+func ReadRecording(r io.Reader) ([]*Record, error) {
+	var records []*Record
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// ReplayOptions control which records are replayed, and how quickly
+type ReplayOptions struct {
+	Direction    Direction // Only replay records in this direction. Defaults to Incoming.
+	Subscription string    // If set, only replay incoming messages that were delivered to this topic filter
+	Speed        float64   // 1 keeps the recorded timing, 2 is twice as fast. 0 replays as fast as possible.
+}
+
+// Replay publishes recorded messages to a bus. By default it replays what the recorded module received,
+// so a module under test (connected to the same MemoryBus, say) sees the same traffic it saw in the field.
+// A message delivered to several of the module's subscriptions was recorded once for each, but is only
+// replayed once: as often as any one subscription received it.
+func Replay(bus Bus, records []*Record, options *ReplayOptions) {
+	if options == nil {
+		options = &ReplayOptions{}
+	}
+
+	direction := options.Direction
+	if direction == "" {
+		direction = Incoming
+	}
+
+	var last time.Time
+
+	// How often each incoming message has been replayed, and delivered to each subscription
+	replayed := make(map[string]int)
+	delivered := make(map[string]int)
+
+	for _, record := range records {
+		if record.Direction != direction {
+			continue
+		}
+		if options.Subscription != "" && record.Subscription != options.Subscription {
+			continue
+		}
+
+		if record.Direction == Incoming {
+			message := record.messageKey()
+			delivered[record.Subscription+"\x00"+message]++
+			if delivered[record.Subscription+"\x00"+message] <= replayed[message] {
+				continue
+			}
+			replayed[message]++
+		}
+
+		if options.Speed > 0 && !last.IsZero() {
+			time.Sleep(time.Duration(float64(record.Time.Sub(last)) / options.Speed))
+		}
+		last = record.Time
+
+		publishOptions := &PublishOptions{
+			QoS:    record.QoS,
+			Retain: record.Retain,
+		}
+		if propertiesBus, ok := bus.(PropertiesBus); ok && record.Properties != nil {
+			propertiesBus.PublishWithProperties(record.Topic, record.Payload, publishOptions, record.Properties)
+		} else {
+			bus.PublishWithOptions(record.Topic, record.Payload, publishOptions)
+		}
+	}
+}
+
+// messageKey identifies the message a record is of, to tell when the same one was delivered to more
+// than one subscription
+func (r *Record) messageKey() string {
+	key := r.Topic + "\x00" + string(r.Payload)
+	if r.Properties != nil {
+		key += "\x00" + r.Properties.ResponseTopic + "\x00" + string(r.Properties.CorrelationData)
+	}
+	return key
+}
@@ -0,0 +1,166 @@
+package bus
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRecordingBus(t *testing.T) {
+	memory, _ := ConnectMemoryBus("TestRecordingBus", "recorded")
+	defer memory.Destroy()
+
+	ring := NewRingBuffer(10)
+	bus := NewRecordingBus(memory, ring)
+
+	received := make(chan string, 10)
+	bus.Subscribe("$device/+/event/state", recorder(received))
+
+	bus.PublishWithOptions("$device/1/event/state", []byte(`{"params":[true]}`), &PublishOptions{Retain: true})
+	bus.Publish("$device/2/event/state", []byte{0xff, 0x00})
+	expect(t, received, `$device/1/event/state {"params":[true]}`, "$device/2/event/state \xff\x00")
+
+	records := ring.Records()
+	if len(records) != 4 {
+		t.Fatalf("Expected 2 outgoing and 2 incoming records, got %d", len(records))
+	}
+
+	if records[0].Direction != Outgoing || !records[0].Retain || records[0].Topic != "$device/1/event/state" {
+		t.Errorf("Unexpected first record: %+v", records[0])
+	}
+
+	// Round trip through JSON lines, and replay what the module received into another bus
+	var buf bytes.Buffer
+	if _, err := ring.WriteTo(&buf); err != nil {
+		t.Fatalf("Failed to write recording: %s", err)
+	}
+
+	recording, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read recording: %s", err)
+	}
+
+	replayer, _ := ConnectMemoryBus("TestRecordingBusReplay", "replayer")
+	defer replayer.Destroy()
+	listener, _ := ConnectMemoryBus("TestRecordingBusReplay", "listener")
+	defer listener.Destroy()
+
+	listener.Subscribe("#", recorder(received))
+
+	Replay(replayer, recording, nil)
+	expect(t, received, `$device/1/event/state {"params":[true]}`, "$device/2/event/state \xff\x00")
+}
+
+func TestRingBufferWraps(t *testing.T) {
+	ring := NewRingBuffer(3)
+	for _, topic := range []string{"a", "b", "c", "d", "e"} {
+		ring.Record(&Record{Topic: topic})
+	}
+
+	var topics string
+	for _, record := range ring.Records() {
+		topics += record.Topic
+	}
+	if topics != "cde" {
+		t.Errorf("Expected the last 3 records oldest first, got %s", topics)
+	}
+}
+
+func TestRecordingBusProperties(t *testing.T) {
+	memory, _ := ConnectMemoryBus("TestRecordingBusProperties", "recorded")
+	defer memory.Destroy()
+
+	// Wrapping a bus mustn't change whether it can carry properties
+	if _, ok := NewRecordingBus(struct{ Bus }{memory}, NewRingBuffer(1)).(PropertiesBus); ok {
+		t.Errorf("Expected recording a plain bus not to give a PropertiesBus")
+	}
+
+	ring := NewRingBuffer(10)
+	bus, ok := NewRecordingBus(memory, ring).(PropertiesBus)
+	if !ok {
+		t.Fatalf("Expected recording a PropertiesBus to give a PropertiesBus")
+	}
+
+	received := make(chan *MessageProperties, 1)
+	bus.SubscribeWithProperties("request", nil, func(topic string, payload []byte, properties *MessageProperties) {
+		received <- properties
+	})
+
+	sent := &MessageProperties{ResponseTopic: "reply/1", CorrelationData: []byte("42")}
+	bus.PublishWithProperties("request", []byte(`{}`), nil, sent)
+
+	select {
+	case properties := <-received:
+		if properties == nil || properties.ResponseTopic != "reply/1" {
+			t.Errorf("The properties weren't forwarded: %+v", properties)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+
+	// Both directions are recorded with their properties, which survive a round trip through JSON lines
+	var buf bytes.Buffer
+	ring.WriteTo(&buf)
+	records, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read recording: %s", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected an outgoing and an incoming record, got %d", len(records))
+	}
+	for _, record := range records {
+		if record.Properties == nil || record.Properties.ResponseTopic != "reply/1" || string(record.Properties.CorrelationData) != "42" {
+			t.Errorf("The %s record lost its properties: %+v", record.Direction, record.Properties)
+		}
+	}
+}
+
+func TestReplayOverlappingSubscriptions(t *testing.T) {
+	memory, _ := ConnectMemoryBus("TestReplayOverlappingSubscriptions", "recorded")
+	defer memory.Destroy()
+
+	ring := NewRingBuffer(10)
+	bus := NewRecordingBus(memory, ring)
+
+	received := make(chan string, 10)
+	bus.Subscribe("a/#", recorder(received))
+	bus.Subscribe("a/+", recorder(received))
+
+	// The same message twice, each delivered to both subscriptions
+	bus.Publish("a/b", []byte("twice"))
+	bus.Publish("a/b", []byte("twice"))
+	expect(t, received, "a/b twice", "a/b twice", "a/b twice", "a/b twice")
+
+	replayer, _ := ConnectMemoryBus("TestReplayOverlappingSubscriptionsReplay", "replayer")
+	defer replayer.Destroy()
+	listener, _ := ConnectMemoryBus("TestReplayOverlappingSubscriptionsReplay", "listener")
+	defer listener.Destroy()
+
+	listener.Subscribe("#", recorder(received))
+
+	Replay(replayer, ring.Records(), nil)
+	expect(t, received, "a/b twice", "a/b twice")
+}
+
+func TestRecordKeepsPayloadBytes(t *testing.T) {
+	for _, payload := range []string{"{ \"html\": \"<b>&</b>\" }\n", "plain text", `"quoted"`, "\xff\x00"} {
+		line, err := json.Marshal(&Record{Topic: "test", Payload: []byte(payload)})
+		if err != nil {
+			t.Fatalf("Failed to encode %q: %s", payload, err)
+		}
+		record := &Record{}
+		if err := json.Unmarshal(line, record); err != nil {
+			t.Fatalf("Failed to decode %s: %s", line, err)
+		}
+		if string(record.Payload) != payload {
+			t.Errorf("Expected the payload %q back, got %q", payload, record.Payload)
+		}
+	}
+
+	// Recordings from before payloads were stored as text
+	record := &Record{}
+	if err := json.Unmarshal([]byte(`{"topic":"test","payload":{"params":[true]}}`), record); err != nil || string(record.Payload) != `{"params":[true]}` {
+		t.Errorf("Failed to read an older record: %q %v", record.Payload, err)
+	}
+}
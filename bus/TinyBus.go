@@ -1,6 +1,7 @@
 package bus
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sync"
@@ -8,24 +9,50 @@ import (
 
 	proto "github.com/huin/mqtt"
 	"github.com/ninjasphere/go-ninja/config"
-	"github.com/ninjasphere/mqtt"
 )
 
+// The return code in a SUBACK when the server refuses a subscription
+const subscriptionRefused = proto.QosLevel(0x80)
+
+// TinyBus is our own MQTT 3.1.1 client, and the default Bus. It can't carry MQTT 5 message properties,
+// so it isn't a PropertiesBus.
 type TinyBus struct {
 	baseBus
-	connecting    sync.WaitGroup
-	mqtt          *mqtt.ClientConn
-	subscriptions []*Subscription
-	host          string
-	id            string
+	mutex          sync.Mutex // protects mqtt and subscriptions
+	mqtt           *clientConn
+	subscriptions  []*Subscription
+	filters        filterLocks
+	queue          *publishQueue
+	backoff        *backoff
+	connectTimeout time.Duration
+	keepAlive      time.Duration
+	pingTimeout    time.Duration
+	tlsConfig      *tls.Config
+	username       string
+	password       string
+	host           string
+	id             string
 }
 
 func ConnectTinyBus(host, id string) (*TinyBus, error) {
 
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	bus := &TinyBus{
-		subscriptions: make([]*Subscription, 0),
-		host:          host,
-		id:            id,
+		subscriptions:  make([]*Subscription, 0),
+		queue:          newPublishQueue(config.Int(1000, "mqtt", "queue", "size"), QueuePolicy(config.String(string(DropOldest), "mqtt", "queue", "policy"))),
+		backoff:        newBackoff(config.Duration(time.Millisecond*500, "mqtt", "backoff", "initial"), config.Duration(time.Second*30, "mqtt", "backoff", "max")),
+		connectTimeout: config.Duration(time.Second*10, "mqtt", "connectTimeout"),
+		keepAlive:      config.Duration(time.Second*30, "mqtt", "keepAlive"),
+		pingTimeout:    config.Duration(time.Second*10, "mqtt", "pingTimeout"),
+		tlsConfig:      tlsConfig,
+		username:       config.String("", "mqtt", "username"),
+		password:       config.String("", "mqtt", "password"),
+		host:           host,
+		id:             id,
 	}
 
 	bus.connect()
@@ -35,154 +62,343 @@ func ConnectTinyBus(host, id string) (*TinyBus, error) {
 
 type wrappedConn struct {
 	net.Conn
-	done chan bool
+	done      chan bool
+	closeOnce sync.Once
 }
 
-func (c wrappedConn) Close() error {
-	log.Warningf("Connection closed!")
-	c.done <- true
-	c.Conn.Close()
+func (c *wrappedConn) Close() error {
+	c.closeOnce.Do(func() {
+		log.Warningf("Connection closed!")
+		c.done <- true
+		c.Conn.Close()
+	})
 	return nil
 }
 
 func (b *TinyBus) connect() {
 
-	b.connecting.Add(1)
-	defer func() {
-		b.connecting.Done()
-
-		b.publish(&proto.Publish{
-			Header: proto.Header{
-				Retain: true,
-			},
-			TopicName: fmt.Sprintf("node/%s/module/%s/state/connected", config.Serial(), b.id),
-			Payload:   proto.BytesPayload([]byte("true")),
-		})
-	}()
-
-	var conn wrappedConn
+	var conn *wrappedConn
+	var mqtt *clientConn
 	for {
-		tcpConn, err := net.Dial("tcp", b.host)
+		if b.isDestroyed() {
+			return
+		}
+
+		var err error
+		conn, mqtt, err = b.dial()
 		if err == nil {
-			conn = wrappedConn{
-				Conn: tcpConn,
-				done: make(chan bool, 1),
-			}
 			break
 		}
 
-		//log.Warningf("Failed to connect to: %s", err)
-		time.Sleep(time.Millisecond * 500)
+		delay := b.backoff.next()
+		log.Debugf("Failed to connect to mqtt server %s: %s. Retrying in %s", b.host, err, delay)
+		time.Sleep(delay)
 	}
+	b.backoff.reset()
+
+	// Swapping the connection under the lock means a concurrent Subscribe either sees the new
+	// connection, or is already in the subscriptions we resubscribe below.
+	b.mutex.Lock()
+	if b.isDestroyed() {
+		b.mutex.Unlock()
+		mqtt.Disconnect()
+		return
+	}
+	previous := b.mqtt
+	b.mqtt = mqtt
+	b.mutex.Unlock()
 
-	if b.mqtt != nil {
+	if previous != nil {
 		log.Infof("Reconnected to mqtt server")
 	}
 
-	mqtt := mqtt.NewClientConn(conn)
-	mqtt.ClientId = b.id
-
-	err := mqtt.ConnectCustom(&proto.Connect{
-		WillFlag:    true,
-		WillQos:     0,
-		WillRetain:  true,
-		WillTopic:   fmt.Sprintf("$node/%s/module/%s/state/connected", config.Serial(), b.id),
-		WillMessage: "false",
-	})
-
-	if err != nil {
-		log.Fatalf("MQTT Failed to connect to: %s", err)
+	if b.keepAlive > 0 {
+		go mqtt.keepAlive(b.keepAlive, b.pingTimeout)
 	}
 
-	b.mqtt = mqtt
-
 	b.connected()
 
-	for _, s := range b.subscriptions {
-		if !s.cancelled {
-			b.subscribe(s)
-		}
-	}
-
 	go func() {
 		for m := range mqtt.Incoming {
 			b.onIncoming(m)
 		}
 	}()
 
+	for _, tq := range b.subscribedTopics() {
+		unlock := b.filters.lock(tq.Topic)
+		// It may have been cancelled since, and the server told about it
+		if b.listening(tq.Topic) {
+			if err := b.subscribe(mqtt, tq.Topic, b.subscribedQoS(tq.Topic)); err != nil {
+				log.Warningf("Failed to resubscribe: %s", err)
+			}
+		}
+		unlock()
+	}
+
+	// Anything sent at QoS 1 or 2 that the old connection never confirmed needs to be sent again,
+	// marked as a duplicate as the spec requires
+	if previous != nil {
+		unacknowledged := previous.unacknowledged()
+		for _, msg := range unacknowledged {
+			msg.DupFlag = true
+		}
+		b.queue.requeue(unacknowledged)
+	}
+
+	b.publish(mqtt, &proto.Publish{
+		Header: proto.Header{
+			Retain: true,
+		},
+		TopicName: fmt.Sprintf("node/%s/module/%s/state/connected", config.Serial(), b.id),
+		Payload:   proto.BytesPayload([]byte("true")),
+	})
+
+	// Send everything that was published while we were disconnected
+	b.queue.flush(b.send)
+
 	go func() {
 		<-conn.done
+		b.queue.offline()
 		b.disconnected()
-		if !b.destroyed {
+		if !b.isDestroyed() {
 			b.connect()
 		}
 	}()
 }
 
+// dial opens a connection (using TLS if configured) to the mqtt server, and completes the CONNECT
+// handshake within connectTimeout
+func (b *TinyBus) dial() (*wrappedConn, *clientConn, error) {
+	var tcpConn net.Conn
+	var err error
+
+	if b.tlsConfig != nil {
+		tcpConn, err = tls.DialWithDialer(&net.Dialer{Timeout: b.connectTimeout}, "tcp", b.host, b.tlsConfig)
+	} else {
+		tcpConn, err = net.DialTimeout("tcp", b.host, b.connectTimeout)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn := &wrappedConn{
+		Conn: tcpConn,
+		done: make(chan bool, 1),
+	}
+
+	mqtt := newClientConn(conn)
+	mqtt.ClientId = b.id
+
+	conn.SetDeadline(time.Now().Add(b.connectTimeout))
+
+	err = mqtt.Connect(&proto.Connect{
+		WillFlag:       true,
+		WillQos:        0,
+		WillRetain:     true,
+		WillTopic:      fmt.Sprintf("$node/%s/module/%s/state/connected", config.Serial(), b.id),
+		WillMessage:    "false",
+		KeepAliveTimer: uint16(b.keepAlive / time.Second),
+		UsernameFlag:   b.username != "",
+		Username:       b.username,
+		PasswordFlag:   b.password != "",
+		Password:       b.password,
+	})
+
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("MQTT handshake failed: %s", err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, mqtt, nil
+}
+
 func (b *TinyBus) onIncoming(msg *proto.Publish) {
 
-	for _, sub := range b.subscriptions {
-		if !sub.cancelled && matches(sub.topic, msg.TopicName) {
-			sub.c <- &message{msg.TopicName, []byte(msg.Payload.(proto.BytesPayload))}
+	b.mutex.Lock()
+	subscriptions := make([]*Subscription, len(b.subscriptions))
+	copy(subscriptions, b.subscriptions)
+	b.mutex.Unlock()
+
+	for _, sub := range subscriptions {
+		if matches(sub.topic, msg.TopicName) {
+			sub.deliver(&message{topic: msg.TopicName, payload: []byte(msg.Payload.(proto.BytesPayload))})
 		}
 	}
 }
 
 func (b *TinyBus) Destroy() {
 	log.Infof("Destroy called")
-	b.destroyed = true
-	b.mqtt.Disconnect()
+	b.destroy()
+	b.client().Disconnect()
+}
+
+// client returns the current mqtt connection, which is replaced each time we reconnect
+func (b *TinyBus) client() *clientConn {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.mqtt
 }
 
 func (b *TinyBus) Publish(topic string, payload []byte) {
-	b.connecting.Wait()
+	b.PublishWithOptions(topic, payload, nil)
+}
 
-	b.publish(&proto.Publish{
+// PublishWithOptions publishes a message. While we are disconnected it is held in the offline
+// queue (configured with mqtt.queue.size and mqtt.queue.policy) and sent once we reconnect.
+func (b *TinyBus) PublishWithOptions(topic string, payload []byte, options *PublishOptions) {
+	if options == nil {
+		options = &PublishOptions{}
+	}
+
+	b.queue.publish(&proto.Publish{
+		Header: proto.Header{
+			QosLevel: proto.QosLevel(options.QoS),
+			Retain:   options.Retain,
+		},
 		TopicName: topic,
 		Payload:   proto.BytesPayload(payload),
-	})
+	}, b.send)
 
 }
 
-func (b *TinyBus) publish(message *proto.Publish) {
-	b.mqtt.Publish(message)
+// QueueStats returns the counters of the offline publish queue, for monitoring
+func (b *TinyBus) QueueStats() QueueStats {
+	return b.queue.Stats()
 }
 
-func (b *TinyBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error) {
+func (b *TinyBus) send(message *proto.Publish) error {
+	return b.client().Publish(message)
+}
 
-	subscription := &Subscription{
-		topic: topic,
-		c:     make(chan *message),
+// publish sends a message immediately on a connection, bypassing the offline queue
+func (b *TinyBus) publish(mqtt *clientConn, message *proto.Publish) {
+	if err := mqtt.Publish(message); err != nil {
+		log.Warningf("Failed to publish to %s: %s", message.TopicName, err)
 	}
+}
 
-	go func() {
-		for m := range subscription.c {
-			if subscription.cancelled {
-				break
-			}
-			callback(m.topic, m.payload)
-		}
-	}()
+func (b *TinyBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.SubscribeWithOptions(topic, nil, callback)
+}
+
+func (b *TinyBus) SubscribeWithOptions(topic string, options *SubscribeOptions, callback func(topic string, payload []byte)) (*Subscription, error) {
+	subscription := newSubscription(topic, options, withoutProperties(callback))
 
 	subscription.Cancel = func() {
-		// TODO: Actually unsubscribe if we were the only one listening
-		// TODO: Remove from from b.subscriptions
-		subscription.cancelled = true
+		if !subscription.cancel() {
+			return
+		}
+
+		unlock := b.filters.lock(topic)
+		defer unlock()
+
+		// Only unsubscribe from the server if nobody else here is still listening
+		if b.remove(subscription) && b.Connected() {
+			if err := b.client().Unsubscribe([]string{topic}); err != nil {
+				log.Warningf("Failed to unsubscribe from %s: %s", topic, err)
+			}
+		}
 	}
 
-	err := b.subscribe(subscription)
+	unlock := b.filters.lock(topic)
+	defer unlock()
+
+	b.mutex.Lock()
+	b.subscriptions = append(b.subscriptions, subscription)
+	mqtt := b.mqtt
+	b.mutex.Unlock()
+
+	// If someone here is already listening at a higher QoS, we mustn't downgrade them
+	err := b.subscribe(mqtt, topic, b.subscribedQoS(topic))
 	if err != nil {
+		// The server refused it, so there is nothing to unsubscribe from
+		subscription.cancel()
+		b.remove(subscription)
 		return nil, err
 	}
 
-	b.subscriptions = append(b.subscriptions, subscription)
-
 	return subscription, nil
 }
 
-func (b *TinyBus) subscribe(subscription *Subscription) error {
-	_ = b.mqtt.Subscribe([]proto.TopicQos{proto.TopicQos{subscription.topic, proto.QosAtMostOnce}})
-	//spew.Dump("subscription ack", ack)
-	// TODO: Check ack
+// listening reports whether we still have a subscription to a topic filter
+func (b *TinyBus) listening(topic string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, s := range b.subscriptions {
+		if s.topic == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// remove drops a subscription, returning true if it was the last one for its topic filter
+func (b *TinyBus) remove(subscription *Subscription) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i, s := range b.subscriptions {
+		if s == subscription {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			break
+		}
+	}
+
+	for _, s := range b.subscriptions {
+		if s.topic == subscription.topic {
+			return false
+		}
+	}
+	return true
+}
+
+// subscribedTopics returns each topic filter we have a subscription for, once, with the highest
+// QoS any of its subscriptions asked for
+func (b *TinyBus) subscribedTopics() []proto.TopicQos {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	index := make(map[string]int)
+	topics := []proto.TopicQos{}
+	for _, s := range b.subscriptions {
+		i, ok := index[s.topic]
+		if !ok {
+			index[s.topic] = len(topics)
+			topics = append(topics, proto.TopicQos{Topic: s.topic, Qos: proto.QosLevel(s.qos)})
+		} else if proto.QosLevel(s.qos) > topics[i].Qos {
+			topics[i].Qos = proto.QosLevel(s.qos)
+		}
+	}
+	return topics
+}
+
+// subscribedQoS returns the highest QoS of our subscriptions to a topic filter
+func (b *TinyBus) subscribedQoS(topic string) QoS {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	qos := QoSAtMostOnce
+	for _, s := range b.subscriptions {
+		if s.topic == topic && s.qos > qos {
+			qos = s.qos
+		}
+	}
+	return qos
+}
+
+func (b *TinyBus) subscribe(mqtt *clientConn, topic string, qos QoS) error {
+	ack, err := mqtt.Subscribe([]proto.TopicQos{proto.TopicQos{Topic: topic, Qos: proto.QosLevel(qos)}})
+	if err != nil {
+		// We've lost the connection, we will subscribe again once we reconnect.
+		log.Warningf("Failed to subscribe to %s: %s", topic, err)
+		return nil
+	}
+
+	if len(ack.TopicsQos) != 1 || ack.TopicsQos[0] == subscriptionRefused {
+		return fmt.Errorf("Subscription to %s was refused by the mqtt server", topic)
+	}
 	return nil
 }
@@ -0,0 +1,447 @@
+package bus
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+func isUnsubscribe(topic string) func(msg proto.Message) bool {
+	return func(msg proto.Message) bool {
+		unsub, ok := msg.(*proto.Unsubscribe)
+		return ok && len(unsub.Topics) == 1 && unsub.Topics[0] == topic
+	}
+}
+
+func TestTinyBusCancelUnsubscribesLastListener(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	bus, err := ConnectTinyBus(broker.addr(), "TestTinyBusCancel")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer bus.Destroy()
+
+	received := make(chan string, 10)
+
+	first, _ := bus.Subscribe("test/#", func(topic string, payload []byte) {
+		received <- "first"
+	})
+	second, _ := bus.Subscribe("test/#", func(topic string, payload []byte) {
+		received <- "second"
+	})
+
+	first.Cancel()
+
+	if broker.count(isUnsubscribe("test/#")) != 0 {
+		t.Errorf("Unsubscribed while another listener remained")
+	}
+
+	bus.Publish("test/topic", []byte("hello"))
+
+	select {
+	case who := <-received:
+		if who != "second" {
+			t.Errorf("Cancelled subscription received a message")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+
+	second.Cancel()
+
+	if broker.count(isUnsubscribe("test/#")) != 1 {
+		t.Errorf("Expected an UNSUBSCRIBE once the last listener was cancelled")
+	}
+
+	bus.mutex.Lock()
+	remaining := len(bus.subscriptions)
+	bus.mutex.Unlock()
+
+	if remaining != 0 {
+		t.Errorf("Expected cancelled subscriptions to be removed, %d remain", remaining)
+	}
+}
+
+func TestTinyBusSubscribeRacingCancel(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	bus, err := ConnectTinyBus(broker.addr(), "TestTinyBusSubscribeRacingCancel")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer bus.Destroy()
+
+	first, _ := bus.Subscribe("race", func(topic string, payload []byte) {})
+
+	// Holding the state lock stops the cancel between deciding to unsubscribe (it's the last
+	// listener) and checking we're connected to send the UNSUBSCRIBE
+	bus.stateMutex.Lock()
+
+	cancelled := make(chan bool)
+	go func() {
+		first.Cancel()
+		cancelled <- true
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		bus.mutex.Lock()
+		removed := len(bus.subscriptions) == 0
+		bus.mutex.Unlock()
+		if removed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the cancel")
+		}
+	}
+
+	subscribed := make(chan bool)
+	go func() {
+		bus.Subscribe("race", func(topic string, payload []byte) {})
+		subscribed <- true
+	}()
+
+	// The subscribe mustn't reach the server before the cancel's UNSUBSCRIBE does
+	select {
+	case <-subscribed:
+		bus.stateMutex.Unlock()
+		<-cancelled
+	case <-time.After(time.Millisecond * 100):
+		bus.stateMutex.Unlock()
+		<-cancelled
+		<-subscribed
+	}
+
+	if !broker.subscribed("race") {
+		t.Errorf("The server was unsubscribed while a listener remained")
+	}
+}
+
+func TestTinyBusPublishQoS(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	bus, err := ConnectTinyBus(broker.addr(), "TestTinyBusPublishQoS")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer bus.Destroy()
+
+	bus.PublishWithOptions("test/qos1", []byte("1"), &PublishOptions{QoS: QoSAtLeastOnce, Retain: true})
+	bus.PublishWithOptions("test/qos2", []byte("2"), &PublishOptions{QoS: QoSExactlyOnce})
+
+	deadline := time.Now().Add(time.Second)
+	for len(bus.client().unacknowledged()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Messages were never acknowledged")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	retained := broker.count(func(msg proto.Message) bool {
+		p, ok := msg.(*proto.Publish)
+		return ok && p.TopicName == "test/qos1" && p.QosLevel == proto.QosAtLeastOnce && p.Retain
+	})
+	if retained != 1 {
+		t.Errorf("Expected a retained QoS 1 publish")
+	}
+
+	released := broker.count(func(msg proto.Message) bool {
+		_, ok := msg.(*proto.PubRel)
+		return ok
+	})
+	if released != 1 {
+		t.Errorf("Expected the QoS 2 publish to be released")
+	}
+}
+
+func TestTinyBusQueuesWhileDisconnected(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	bus, err := ConnectTinyBus(broker.addr(), "TestTinyBusQueues")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer bus.Destroy()
+
+	disconnected := make(chan bool, 1)
+	bus.OnDisconnect(func() {
+		disconnected <- true
+	})
+
+	broker.dropClients()
+	<-disconnected
+
+	for i := 0; i < 3; i++ {
+		bus.Publish(fmt.Sprintf("test/queued/%d", i), []byte("hello"))
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for bus.QueueStats().Flushed < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Queued messages were never flushed: %+v", bus.QueueStats())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	var order []string
+	broker.count(func(msg proto.Message) bool {
+		if p, ok := msg.(*proto.Publish); ok && strings.HasPrefix(p.TopicName, "test/queued/") {
+			order = append(order, p.TopicName)
+		}
+		return false
+	})
+
+	if fmt.Sprintf("%v", order) != "[test/queued/0 test/queued/1 test/queued/2]" {
+		t.Errorf("Queued messages were not flushed in order: %v", order)
+	}
+}
+
+func TestTinyBusResendsUnacknowledgedAsDuplicates(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	bus, err := ConnectTinyBus(broker.addr(), "TestTinyBusResends")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer bus.Destroy()
+
+	isResend := func(dup bool) func(msg proto.Message) bool {
+		return func(msg proto.Message) bool {
+			p, ok := msg.(*proto.Publish)
+			return ok && p.TopicName == "test/resent" && p.DupFlag == dup
+		}
+	}
+
+	broker.mutex.Lock()
+	broker.withholdAcks = true
+	broker.mutex.Unlock()
+
+	bus.PublishWithOptions("test/resent", []byte("hello"), &PublishOptions{QoS: QoSAtLeastOnce})
+
+	deadline := time.Now().Add(time.Second * 5)
+	for broker.count(isResend(false)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The publish never arrived")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	broker.mutex.Lock()
+	broker.withholdAcks = false
+	broker.mutex.Unlock()
+	broker.dropClients()
+
+	for broker.count(isResend(true)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The unacknowledged publish was never resent as a duplicate")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestTinyBusRetriesRefusedHandshake(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	broker.mutex.Lock()
+	broker.refuse = 2
+	broker.mutex.Unlock()
+
+	bus, err := ConnectTinyBus(broker.addr(), "TestTinyBusRetries")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer bus.Destroy()
+
+	if !bus.Connected() {
+		t.Errorf("Expected to be connected once the server accepted us")
+	}
+
+	connects := broker.count(func(msg proto.Message) bool {
+		_, ok := msg.(*proto.Connect)
+		return ok
+	})
+	if connects != 3 {
+		t.Errorf("Expected 3 connection attempts, got %d", connects)
+	}
+}
+
+func TestTinyBusReconnectsWhenPingsGoUnanswered(t *testing.T) {
+	os.Setenv("sphere_mqtt_keepAlive", "50ms")
+	os.Setenv("sphere_mqtt_pingTimeout", "50ms")
+	config.MustRefresh()
+	defer func() {
+		os.Unsetenv("sphere_mqtt_keepAlive")
+		os.Unsetenv("sphere_mqtt_pingTimeout")
+		config.MustRefresh()
+	}()
+
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	bus, err := ConnectTinyBus(broker.addr(), "TestTinyBusPings")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer bus.Destroy()
+
+	disconnected := make(chan bool, 1)
+	bus.OnDisconnect(func() {
+		disconnected <- true
+	})
+
+	// Answered pings keep the connection up
+	select {
+	case <-disconnected:
+		t.Fatalf("Disconnected while the server was answering pings")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	broker.mutex.Lock()
+	broker.ignorePings = true
+	broker.mutex.Unlock()
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected to disconnect when pings went unanswered")
+	}
+}
+
+// Run with -race. Subscribes, cancels, publishes and status checks all run while the server keeps
+// dropping us, and the bus must still work afterwards.
+func TestTinyBusConcurrentUse(t *testing.T) {
+	os.Setenv("sphere_mqtt_backoff_initial", "5ms")
+	os.Setenv("sphere_mqtt_backoff_max", "20ms")
+	config.MustRefresh()
+	defer func() {
+		os.Unsetenv("sphere_mqtt_backoff_initial")
+		os.Unsetenv("sphere_mqtt_backoff_max")
+		config.MustRefresh()
+	}()
+
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	bus, err := ConnectTinyBus(broker.addr(), "TestTinyBusConcurrentUse")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer bus.Destroy()
+
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				f(i)
+			}
+		}()
+	}
+
+	for n := 0; n < 4; n++ {
+		topic := fmt.Sprintf("hammer/%d/#", n%2)
+		run(func(i int) {
+			sub, err := bus.SubscribeWithOptions(topic, &SubscribeOptions{QoS: QoS(i % 3)}, func(topic string, payload []byte) {})
+			if err == nil {
+				sub.Cancel()
+			}
+		})
+		run(func(i int) {
+			bus.PublishWithOptions(fmt.Sprintf("hammer/%d/%d", i%2, i), []byte("hello"), &PublishOptions{QoS: QoS(i % 3)})
+		})
+	}
+
+	run(func(i int) {
+		bus.OnConnect(func() {})
+		bus.OnDisconnect(func() {})
+		bus.Connected()
+		bus.QueueStats()
+		time.Sleep(time.Millisecond)
+	})
+
+	run(func(i int) {
+		broker.dropClients()
+		time.Sleep(time.Millisecond * 20)
+	})
+
+	time.Sleep(time.Millisecond * 500)
+	close(stop)
+	wg.Wait()
+
+	received := make(chan bool, 1)
+	if _, err := bus.Subscribe("hammer/done", func(topic string, payload []byte) {
+		select {
+		case received <- true:
+		default:
+		}
+	}); err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+	}
+
+	// We may still be reconnecting from the last drop, in which case the message is queued
+	bus.Publish("hammer/done", []byte("hello"))
+
+	select {
+	case <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Bus stopped working after concurrent use")
+	}
+}
+
+func TestTinyBusSlowSubscriberDoesNotStallOthers(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	bus, err := ConnectTinyBus(broker.addr(), "TestTinyBusSlowSubscriber")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer bus.Destroy()
+
+	release := make(chan bool)
+	defer close(release)
+
+	slow, _ := bus.SubscribeWithOptions("slow", &SubscribeOptions{BufferSize: 5}, func(topic string, payload []byte) {
+		<-release
+	})
+
+	received := make(chan bool, 1)
+	bus.Subscribe("fast", func(topic string, payload []byte) {
+		received <- true
+	})
+
+	for i := 0; i < 20; i++ {
+		bus.Publish("slow", []byte("hello"))
+	}
+	bus.Publish("fast", []byte("hello"))
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("A blocked subscriber stopped other subscriptions receiving messages")
+	}
+
+	if stats := slow.Stats(); stats.Dropped == 0 || stats.Length > 5 {
+		t.Errorf("Expected the slow subscription to drop messages once its buffer filled: %+v", stats)
+	}
+}
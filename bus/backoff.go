@@ -0,0 +1,51 @@
+package bus
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff produces exponentially increasing, jittered delays between reconnection attempts, so
+// that many modules restarting together don't all hammer the mqtt server in lockstep.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	attempt uint
+	random  *rand.Rand
+}
+
+func newBackoff(initial, max time.Duration) *backoff {
+	if initial <= 0 {
+		initial = time.Millisecond * 500
+	}
+	if max < initial {
+		max = initial
+	}
+	return &backoff{
+		initial: initial,
+		max:     max,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns how long to wait before the next attempt. It is somewhere between half and all of
+// the current exponential delay.
+func (b *backoff) next() time.Duration {
+	// Doubling stops at the max, so a large initial delay can't overflow
+	delay := b.initial
+	for i := uint(0); i < b.attempt && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	b.attempt++
+
+	half := delay / 2
+	return half + time.Duration(b.random.Int63n(int64(delay-half)+1))
+}
+
+// reset starts the delays again from the initial value, once we have successfully connected
+func (b *backoff) reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,34 @@
+package bus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, time.Second*10)
+
+	for i, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		max = max * time.Second
+		delay := b.next()
+		if delay < max/2 || delay > max {
+			t.Errorf("Attempt %d: expected a delay between %s and %s, got %s", i, max/2, max, delay)
+		}
+	}
+
+	b.reset()
+	if delay := b.next(); delay > time.Second {
+		t.Errorf("Expected reset to start again from the initial delay, got %s", delay)
+	}
+}
+
+func TestBackoffWithLargeInitialDelay(t *testing.T) {
+	for _, initial := range []time.Duration{time.Second * 5, time.Minute} {
+		b := newBackoff(initial, time.Hour)
+		for attempt := 0; attempt < 64; attempt++ {
+			if delay := b.next(); delay < initial/2 || delay > time.Hour {
+				t.Fatalf("Initial %s, attempt %d: delay out of range: %s", initial, attempt, delay)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package bus
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+func init() {
+	// TinyBus includes the serial in its will topic, and we can't assume sphere-go-serial is installed
+	if !config.HasString("serial") {
+		os.Setenv("sphere_serial", "TESTSERIAL")
+		config.MustRefresh()
+	}
+}
+
+// testBroker is just enough of an MQTT server to test TinyBus against
+type testBroker struct {
+	listener net.Listener
+
+	mutex        sync.Mutex // protects following
+	clients      map[net.Conn]map[string]bool
+	received     []proto.Message
+	retained     map[string]*proto.Publish
+	refuse       int  // How many more CONNECTs to refuse
+	ignorePings  bool // Stop answering PINGREQs, like a half-open connection
+	withholdAcks bool // Stop acknowledging QoS 1 and 2 publishes
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	return serveTestBroker(listener)
+}
+
+// newTestTLSBroker starts a test broker that only accepts TLS connections
+func newTestTLSBroker(t *testing.T, tlsConfig *tls.Config) *testBroker {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	return serveTestBroker(listener)
+}
+
+func serveTestBroker(listener net.Listener) *testBroker {
+	b := &testBroker{
+		listener: listener,
+		clients:  make(map[net.Conn]map[string]bool),
+		retained: make(map[string]*proto.Publish),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *testBroker) addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *testBroker) close() {
+	b.listener.Close()
+	b.dropClients()
+}
+
+// dropClients closes every client connection, as if the server had restarted
+func (b *testBroker) dropClients() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for conn := range b.clients {
+		conn.Close()
+	}
+}
+
+// count returns how many messages the broker has received that satisfy the filter
+func (b *testBroker) count(filter func(msg proto.Message) bool) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	n := 0
+	for _, msg := range b.received {
+		if filter(msg) {
+			n++
+		}
+	}
+	return n
+}
+
+// subscribed reports whether any client is subscribed to a topic filter
+func (b *testBroker) subscribed(filter string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, filters := range b.clients {
+		if filters[filter] {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	// Writes are serialised with route() by the broker mutex
+	write := func(msg proto.Message) {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		msg.Encode(conn)
+	}
+
+	b.mutex.Lock()
+	b.clients[conn] = make(map[string]bool)
+	b.mutex.Unlock()
+
+	defer func() {
+		b.mutex.Lock()
+		delete(b.clients, conn)
+		b.mutex.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+
+	for {
+		msg, err := proto.DecodeOneMessage(r, nil)
+		if err != nil {
+			return
+		}
+
+		b.mutex.Lock()
+		b.received = append(b.received, msg)
+		b.mutex.Unlock()
+
+		switch msg := msg.(type) {
+		case *proto.Connect:
+			b.mutex.Lock()
+			refuse := b.refuse > 0
+			b.refuse--
+			b.mutex.Unlock()
+
+			if refuse {
+				write(&proto.ConnAck{ReturnCode: proto.RetCodeServerUnavailable})
+				return
+			}
+			write(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted})
+		case *proto.PingReq:
+			b.mutex.Lock()
+			ignore := b.ignorePings
+			b.mutex.Unlock()
+
+			if !ignore {
+				write(&proto.PingResp{})
+			}
+		case *proto.Subscribe:
+			ack := &proto.SubAck{MessageId: msg.MessageId}
+			var retained []*proto.Publish
+			b.mutex.Lock()
+			for _, tq := range msg.Topics {
+				b.clients[conn][tq.Topic] = true
+				ack.TopicsQos = append(ack.TopicsQos, tq.Qos)
+				for topic, r := range b.retained {
+					if matches(tq.Topic, topic) {
+						retained = append(retained, r)
+					}
+				}
+			}
+			b.mutex.Unlock()
+			write(ack)
+			for _, r := range retained {
+				write(r)
+			}
+		case *proto.Unsubscribe:
+			b.mutex.Lock()
+			for _, topic := range msg.Topics {
+				delete(b.clients[conn], topic)
+			}
+			b.mutex.Unlock()
+			write(&proto.UnsubAck{MessageId: msg.MessageId})
+		case *proto.Publish:
+			b.route(msg)
+
+			b.mutex.Lock()
+			withhold := b.withholdAcks
+			b.mutex.Unlock()
+			if withhold {
+				continue
+			}
+
+			switch msg.QosLevel {
+			case proto.QosAtLeastOnce:
+				write(&proto.PubAck{MessageId: msg.MessageId})
+			case proto.QosExactlyOnce:
+				write(&proto.PubRec{MessageId: msg.MessageId})
+			}
+		case *proto.PubRel:
+			write(&proto.PubComp{MessageId: msg.MessageId})
+		case *proto.Disconnect:
+			return
+		}
+	}
+}
+
+func (b *testBroker) route(msg *proto.Publish) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if msg.Retain {
+		if len(msg.Payload.(proto.BytesPayload)) == 0 {
+			delete(b.retained, msg.TopicName)
+		} else {
+			b.retained[msg.TopicName] = &proto.Publish{
+				Header:    proto.Header{Retain: true},
+				TopicName: msg.TopicName,
+				Payload:   msg.Payload,
+			}
+		}
+	}
+
+	for conn, filters := range b.clients {
+		for filter := range filters {
+			if matches(filter, msg.TopicName) {
+				(&proto.Publish{
+					TopicName: msg.TopicName,
+					Payload:   msg.Payload,
+				}).Encode(conn)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package bus
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// A backend connects test clients to a fresh broker, so each conformance test starts from nothing
+type backend struct {
+	name  string
+	setup func(t *testing.T) (connect func(id string) Bus, cleanup func())
+}
+
+var backends = []backend{
+	{"memory", func(t *testing.T) (func(id string) Bus, func()) {
+		host := fmt.Sprintf("conformance-%s-%d", t.Name(), time.Now().UnixNano())
+		return func(id string) Bus {
+			bus, _ := ConnectMemoryBus(host, id)
+			return bus
+		}, func() {}
+	}},
+	{"tiny", func(t *testing.T) (func(id string) Bus, func()) {
+		broker := newTestBroker(t)
+		return func(id string) Bus {
+			bus, err := ConnectTinyBus(broker.addr(), id)
+			if err != nil {
+				t.Fatalf("Failed to connect: %s", err)
+			}
+			return bus
+		}, broker.close
+	}},
+	{"paho", func(t *testing.T) (func(id string) Bus, func()) {
+		broker := newTestBroker(t)
+		return func(id string) Bus {
+			bus, err := ConnectPahoBus(broker.addr(), id)
+			if err != nil {
+				t.Fatalf("Failed to connect: %s", err)
+			}
+			return bus
+		}, broker.close
+	}},
+}
+
+// Every Bus implementation must pass these, so drivers can move between them without noticing
+var conformanceTests = []struct {
+	name string
+	test func(t *testing.T, connect func(id string) Bus)
+}{
+	{"PubSub", testConformancePubSub},
+	{"SharedFilter", testConformanceSharedFilter},
+	{"Cancel", testConformanceCancel},
+	{"CancelRacingSubscribe", testConformanceCancelRacingSubscribe},
+	{"PublishFromCallback", testConformancePublishFromCallback},
+	{"QoS", testConformanceQoS},
+	{"Retained", testConformanceRetained},
+	{"Destroy", testConformanceDestroy},
+}
+
+func TestBusConformance(t *testing.T) {
+	for _, backend := range backends {
+		for _, test := range conformanceTests {
+			t.Run(backend.name+"/"+test.name, func(t *testing.T) {
+				connect, cleanup := backend.setup(t)
+				defer cleanup()
+				test.test(t, connect)
+			})
+		}
+	}
+}
+
+// expect waits for the given messages, in any order, and then checks nothing else arrives
+func expect(t *testing.T, received chan string, expected ...string) {
+	var got []string
+	for len(got) < len(expected) {
+		select {
+		case msg := <-received:
+			got = append(got, msg)
+		case <-time.After(time.Second * 2):
+			t.Fatalf("Timed out waiting for messages. Expected %v, got %v", expected, got)
+		}
+	}
+
+	select {
+	case msg := <-received:
+		t.Errorf("Unexpected message: %s", msg)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	sort.Strings(got)
+	sort.Strings(expected)
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func recorder(received chan string) func(topic string, payload []byte) {
+	return func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	}
+}
+
+func testConformancePubSub(t *testing.T, connect func(id string) Bus) {
+	publisher := connect("publisher")
+	defer publisher.Destroy()
+	subscriber := connect("subscriber")
+	defer subscriber.Destroy()
+
+	received := make(chan string, 10)
+
+	if _, err := subscriber.Subscribe("$device/+/channel/#", recorder(received)); err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+	}
+
+	publisher.Publish("$device/1/event/state", []byte("ignored"))
+	publisher.Publish("$device/1/channel/light", []byte("1"))
+	publisher.Publish("$device/2/channel/light/event/state", []byte("2"))
+
+	expect(t, received, "$device/1/channel/light 1", "$device/2/channel/light/event/state 2")
+}
+
+func testConformanceSharedFilter(t *testing.T, connect func(id string) Bus) {
+	bus := connect("shared")
+	defer bus.Destroy()
+
+	received := make(chan string, 10)
+
+	first, _ := bus.Subscribe("test/#", func(topic string, payload []byte) {
+		received <- "first"
+	})
+	bus.Subscribe("test/#", func(topic string, payload []byte) {
+		received <- "second"
+	})
+
+	bus.Publish("test/topic", []byte("hello"))
+	expect(t, received, "first", "second")
+
+	first.Cancel()
+
+	bus.Publish("test/topic", []byte("hello"))
+	expect(t, received, "second")
+}
+
+func testConformanceCancel(t *testing.T, connect func(id string) Bus) {
+	bus := connect("cancel")
+	defer bus.Destroy()
+
+	received := make(chan string, 10)
+
+	sub, _ := bus.Subscribe("test/topic", recorder(received))
+
+	bus.Publish("test/topic", []byte("before"))
+	expect(t, received, "test/topic before")
+
+	sub.Cancel()
+	sub.Cancel()
+
+	bus.Publish("test/topic", []byte("after"))
+	expect(t, received)
+}
+
+// base gives the conformance tests the connection state of buses that have one
+func (b *baseBus) base() *baseBus {
+	return b
+}
+
+// A subscription cancelled while another to the same filter is made mustn't leave the new one deaf
+func testConformanceCancelRacingSubscribe(t *testing.T, connect func(id string) Bus) {
+	bus := connect("race")
+	defer bus.Destroy()
+
+	received := make(chan string, 10)
+
+	first, _ := bus.Subscribe("test/topic", func(topic string, payload []byte) {})
+
+	// Holding the state lock stops a cancel that checks we're connected between deciding to
+	// unsubscribe (it's the last listener) and sending the UNSUBSCRIBE
+	unlock := func() {}
+	if stated, ok := bus.(interface{ base() *baseBus }); ok {
+		stated.base().stateMutex.Lock()
+		unlock = stated.base().stateMutex.Unlock
+	}
+
+	cancelled := make(chan bool)
+	go func() {
+		first.Cancel()
+		cancelled <- true
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	subscribed := make(chan error)
+	go func() {
+		_, err := bus.Subscribe("test/topic", recorder(received))
+		subscribed <- err
+	}()
+
+	// The subscribe mustn't reach the server before the cancel's UNSUBSCRIBE does
+	var err error
+	select {
+	case err = <-subscribed:
+		unlock()
+		<-cancelled
+	case <-time.After(time.Millisecond * 100):
+		unlock()
+		<-cancelled
+		err = <-subscribed
+	}
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+	}
+
+	bus.Publish("test/topic", []byte("hello"))
+	expect(t, received, "test/topic hello")
+}
+
+func testConformancePublishFromCallback(t *testing.T, connect func(id string) Bus) {
+	bus := connect("callback")
+	defer bus.Destroy()
+
+	received := make(chan string, 10)
+
+	bus.Subscribe("request", func(topic string, payload []byte) {
+		bus.Publish("request/reply", payload)
+	})
+	bus.Subscribe("request/reply", recorder(received))
+
+	bus.Publish("request", []byte("hello"))
+	expect(t, received, "request/reply hello")
+}
+
+func testConformanceQoS(t *testing.T, connect func(id string) Bus) {
+	bus := connect("qos")
+	defer bus.Destroy()
+
+	received := make(chan string, 10)
+
+	bus.SubscribeWithOptions("test/#", &SubscribeOptions{QoS: QoSExactlyOnce}, recorder(received))
+
+	bus.PublishWithOptions("test/0", []byte("0"), &PublishOptions{QoS: QoSAtMostOnce})
+	bus.PublishWithOptions("test/1", []byte("1"), &PublishOptions{QoS: QoSAtLeastOnce})
+	bus.PublishWithOptions("test/2", []byte("2"), &PublishOptions{QoS: QoSExactlyOnce})
+
+	expect(t, received, "test/0 0", "test/1 1", "test/2 2")
+}
+
+func testConformanceRetained(t *testing.T, connect func(id string) Bus) {
+	publisher := connect("publisher")
+	defer publisher.Destroy()
+
+	publisher.PublishWithOptions("$device/1/event/state", []byte("old"), &PublishOptions{Retain: true})
+	publisher.PublishWithOptions("$device/1/event/state", []byte("current"), &PublishOptions{Retain: true})
+	publisher.PublishWithOptions("$device/2/event/state", []byte("cleared"), &PublishOptions{Retain: true})
+	publisher.PublishWithOptions("$device/2/event/state", []byte{}, &PublishOptions{Retain: true})
+	publisher.Publish("$device/3/event/state", []byte("not retained"))
+
+	// Publishes are asynchronous, so make sure they have all reached the broker
+	received := make(chan string, 10)
+	publisher.Subscribe("sync", recorder(received))
+	publisher.Publish("sync", []byte("done"))
+	expect(t, received, "sync done")
+
+	subscriber := connect("subscriber")
+	defer subscriber.Destroy()
+
+	subscriber.Subscribe("$device/+/event/state", recorder(received))
+	expect(t, received, "$device/1/event/state current")
+}
+
+func testConformanceDestroy(t *testing.T, connect func(id string) Bus) {
+	bus := connect("destroy")
+
+	if !bus.Connected() {
+		t.Errorf("Expected to be connected")
+	}
+
+	bus.Destroy()
+
+	if bus.Connected() {
+		t.Errorf("Expected not to be connected once destroyed")
+	}
+}
@@ -0,0 +1,47 @@
+package bus
+
+import "sync"
+
+// filterLocks serialise subscribing and unsubscribing each topic filter, for the buses that have to
+// tell a server about them. The zero value is ready to use.
+type filterLocks struct {
+	mutex sync.Mutex // protects locks
+	locks map[string]*filterLock
+}
+
+// filterLock serialises subscribing and unsubscribing a topic filter
+type filterLock struct {
+	sync.Mutex
+	users int // How many are holding or waiting for it. Protected by filterLocks.mutex.
+}
+
+// lock stops anyone else subscribing or unsubscribing a topic filter until the returned func is
+// called. Holding it across deciding what to tell the server and telling it means a SUBSCRIBE and an
+// UNSUBSCRIBE for the same filter can't cross, leaving the server unsubscribed while we still have a
+// listener.
+func (l *filterLocks) lock(topic string) func() {
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*filterLock)
+	}
+	lock, ok := l.locks[topic]
+	if !ok {
+		lock = &filterLock{}
+		l.locks[topic] = lock
+	}
+	lock.users++
+	l.mutex.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		l.mutex.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(l.locks, topic)
+		}
+		l.mutex.Unlock()
+	}
+}
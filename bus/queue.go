@@ -0,0 +1,180 @@
+package bus
+
+import (
+	"sync"
+
+	proto "github.com/huin/mqtt"
+)
+
+// QueuePolicy decides what happens to a message when a bounded queue is full
+type QueuePolicy string
+
+const (
+	DropOldest QueuePolicy = "drop-oldest" // Discard the oldest queued message to make room
+	DropNewest QueuePolicy = "drop-newest" // Discard the message being published
+	Block      QueuePolicy = "block"       // Wait until there is room
+)
+
+// QueueStats are the counters kept by a bus's offline publish queue
+type QueueStats struct {
+	Queued  uint64 // Messages that had to be queued because we weren't connected
+	Dropped uint64 // Messages discarded because the queue was full
+	Flushed uint64 // Queued messages that have since been sent
+	Length  int    // Messages currently waiting to be sent
+}
+
+// publishQueue holds outgoing messages while the bus is disconnected, and sends them in order
+// once it has reconnected.
+type publishQueue struct {
+	mutex    sync.Mutex // protects following
+	space    *sync.Cond
+	size     int
+	policy   QueuePolicy
+	messages []*proto.Publish
+	online   bool
+	full     bool
+	stats    QueueStats
+}
+
+func newPublishQueue(size int, policy QueuePolicy) *publishQueue {
+	switch policy {
+	case DropOldest, DropNewest, Block:
+	default:
+		log.Warningf("Unknown mqtt queue policy '%s', using %s", policy, DropOldest)
+		policy = DropOldest
+	}
+
+	q := &publishQueue{
+		size:   size,
+		policy: policy,
+	}
+	q.space = sync.NewCond(&q.mutex)
+	return q
+}
+
+// publish sends the message straight away if we are connected and nothing is waiting ahead of it,
+// otherwise it is queued.
+func (q *publishQueue) publish(msg *proto.Publish, send func(*proto.Publish) error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		if q.online && len(q.messages) == 0 {
+			q.mutex.Unlock()
+			err := send(msg)
+			q.mutex.Lock()
+			if err == nil {
+				return
+			}
+			log.Infof("Failed to publish to %s, queueing it until we reconnect: %s", msg.TopicName, err)
+		}
+
+		if q.policy != Block || len(q.messages) < q.size {
+			q.enqueue(msg)
+			return
+		}
+
+		q.warnFull()
+		q.space.Wait()
+	}
+}
+
+// enqueue adds a message, dropping one if the queue is full. q.mutex must be held.
+func (q *publishQueue) enqueue(msg *proto.Publish) {
+	if len(q.messages) >= q.size {
+		q.warnFull()
+
+		if q.policy == DropNewest || len(q.messages) == 0 {
+			q.stats.Dropped++
+			return
+		}
+		q.messages = q.messages[1:]
+		q.stats.Dropped++
+	}
+
+	q.messages = append(q.messages, msg)
+	q.stats.Queued++
+}
+
+// warnFull logs the first time the queue fills up while we are disconnected. q.mutex must be held.
+func (q *publishQueue) warnFull() {
+	if !q.full {
+		q.full = true
+		log.Warningf("Offline mqtt publish queue is full (%d messages). Policy: %s", q.size, q.policy)
+	}
+}
+
+// requeue puts messages back at the front of the queue, ahead of anything published since
+func (q *publishQueue) requeue(msgs []*proto.Publish) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	q.stats.Queued += uint64(len(msgs))
+	q.putBack(msgs)
+	q.mutex.Unlock()
+}
+
+// putBack puts messages at the front of the queue, then drops any that no longer fit. Nothing can
+// wait for room here, so the block policy keeps the oldest, as drop-newest does. q.mutex must be held.
+func (q *publishQueue) putBack(msgs []*proto.Publish) {
+	q.messages = append(append([]*proto.Publish{}, msgs...), q.messages...)
+
+	if excess := len(q.messages) - q.size; excess > 0 {
+		q.warnFull()
+
+		if q.policy == DropOldest {
+			q.messages = q.messages[excess:]
+		} else {
+			q.messages = q.messages[:q.size]
+		}
+		q.stats.Dropped += uint64(excess)
+	}
+}
+
+// offline makes all further publishes queue until the next flush
+func (q *publishQueue) offline() {
+	q.mutex.Lock()
+	q.online = false
+	q.mutex.Unlock()
+}
+
+// flush sends the queued messages in order. Once the queue is empty, publishes go straight out again.
+// If a send fails the message is put back and we stay offline.
+func (q *publishQueue) flush(send func(*proto.Publish) error) {
+	for {
+		q.mutex.Lock()
+		if len(q.messages) == 0 {
+			q.online = true
+			q.full = false
+			q.space.Broadcast()
+			q.mutex.Unlock()
+			return
+		}
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		q.mutex.Unlock()
+
+		if err := send(msg); err != nil {
+			q.mutex.Lock()
+			q.putBack([]*proto.Publish{msg})
+			q.mutex.Unlock()
+			return
+		}
+
+		q.mutex.Lock()
+		q.stats.Flushed++
+		q.space.Broadcast()
+		q.mutex.Unlock()
+	}
+}
+
+func (q *publishQueue) Stats() QueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := q.stats
+	stats.Length = len(q.messages)
+	return stats
+}
@@ -0,0 +1,103 @@
+package bus
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func queuedTopics(q *publishQueue) []string {
+	topics := []string{}
+	q.flush(func(msg *proto.Publish) error {
+		topics = append(topics, msg.TopicName)
+		return nil
+	})
+	return topics
+}
+
+func TestPublishQueuePolicies(t *testing.T) {
+	for policy, expected := range map[QueuePolicy]string{
+		DropOldest: "[2 3 4]",
+		DropNewest: "[0 1 2]",
+	} {
+		q := newPublishQueue(3, policy)
+		for i := 0; i < 5; i++ {
+			q.publish(&proto.Publish{TopicName: fmt.Sprintf("%d", i)}, nil)
+		}
+
+		stats := q.Stats()
+		if stats.Queued != 3 && policy == DropNewest || stats.Dropped != 2 || stats.Length != 3 {
+			t.Errorf("%s: unexpected stats %+v", policy, stats)
+		}
+
+		if topics := fmt.Sprintf("%v", queuedTopics(q)); topics != expected {
+			t.Errorf("%s: expected %s to be sent, got %s", policy, expected, topics)
+		}
+
+		if stats := q.Stats(); stats.Flushed != 3 || stats.Length != 0 {
+			t.Errorf("%s: unexpected stats after flush %+v", policy, stats)
+		}
+	}
+}
+
+func TestRequeueKeepsToTheLimit(t *testing.T) {
+	for policy, expected := range map[QueuePolicy]string{
+		DropOldest: "[r2 0 1]",
+		DropNewest: "[r0 r1 r2]",
+		Block:      "[r0 r1 r2]",
+	} {
+		q := newPublishQueue(3, policy)
+		q.publish(&proto.Publish{TopicName: "0"}, nil)
+		q.publish(&proto.Publish{TopicName: "1"}, nil)
+		q.requeue([]*proto.Publish{{TopicName: "r0"}, {TopicName: "r1"}, {TopicName: "r2"}})
+
+		if stats := q.Stats(); stats.Dropped != 2 || stats.Length != 3 {
+			t.Errorf("%s: unexpected stats %+v", policy, stats)
+		}
+
+		if topics := fmt.Sprintf("%v", queuedTopics(q)); topics != expected {
+			t.Errorf("%s: expected %s to be sent, got %s", policy, expected, topics)
+		}
+	}
+}
+
+func TestPublishQueueBlock(t *testing.T) {
+	q := newPublishQueue(1, Block)
+
+	var mutex sync.Mutex
+	sent := []string{}
+	send := func(msg *proto.Publish) error {
+		mutex.Lock()
+		sent = append(sent, msg.TopicName)
+		mutex.Unlock()
+		return nil
+	}
+
+	q.publish(&proto.Publish{TopicName: "0"}, send)
+
+	published := make(chan bool)
+	go func() {
+		q.publish(&proto.Publish{TopicName: "1"}, send)
+		published <- true
+	}()
+
+	select {
+	case <-published:
+		t.Fatalf("Publish to a full queue should have blocked")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	q.flush(send)
+	<-published
+	q.flush(send)
+
+	// Once online and empty, messages go straight out
+	q.publish(&proto.Publish{TopicName: "2"}, send)
+
+	if fmt.Sprintf("%v", sent) != "[0 1 2]" {
+		t.Errorf("Messages sent out of order: %v", sent)
+	}
+}
@@ -0,0 +1,326 @@
+package bus
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// clientConn is the minimal MQTT 3.1 client used by TinyBus. It speaks the wire protocol
+// directly (using huin/mqtt for encoding) so that we can unsubscribe and use QoS 1 and 2,
+// which the generic client connections we used to use could not do.
+type clientConn struct {
+	ClientId string
+	Incoming chan *proto.Publish // Incoming messages arrive on this channel. Closed when the connection drops.
+
+	conn       net.Conn
+	writeMutex sync.Mutex
+
+	mutex    sync.Mutex // protects following
+	nextID   uint16
+	acks     map[uint16]chan proto.Message
+	inflight []*proto.Publish // QoS 1 and 2 messages we have sent that haven't been acknowledged
+	connack  chan *proto.ConnAck
+	closed   bool
+
+	pong chan bool     // Strobes when a PINGRESP arrives
+	done chan struct{} // Closed when the connection drops
+
+	released map[uint16]bool // QoS 2 messages we have delivered, waiting for PUBREL. Only used by reader().
+}
+
+func newClientConn(conn net.Conn) *clientConn {
+	c := &clientConn{
+		Incoming: make(chan *proto.Publish, 100),
+		conn:     conn,
+		acks:     make(map[uint16]chan proto.Message),
+		connack:  make(chan *proto.ConnAck, 1),
+		released: make(map[uint16]bool),
+		pong:     make(chan bool, 1),
+		done:     make(chan struct{}),
+	}
+	go c.reader()
+	return c
+}
+
+func (c *clientConn) reader() {
+	defer func() {
+		c.mutex.Lock()
+		c.closed = true
+		for id, ack := range c.acks {
+			close(ack)
+			delete(c.acks, id)
+		}
+		close(c.connack)
+		close(c.done)
+		c.mutex.Unlock()
+
+		close(c.Incoming)
+		c.conn.Close()
+	}()
+
+	r := bufio.NewReader(c.conn)
+
+	for {
+		msg, err := proto.DecodeOneMessage(r, nil)
+		if err != nil {
+			log.Debugf("MQTT connection read failed: %s", err)
+			return
+		}
+
+		switch msg := msg.(type) {
+		case *proto.Publish:
+			c.receive(msg)
+		case *proto.PubAck:
+			c.complete(msg.MessageId)
+		case *proto.PubRec:
+			c.send(&proto.PubRel{
+				Header:    proto.Header{QosLevel: proto.QosAtLeastOnce},
+				MessageId: msg.MessageId,
+			})
+		case *proto.PubRel:
+			delete(c.released, msg.MessageId)
+			c.send(&proto.PubComp{MessageId: msg.MessageId})
+		case *proto.PubComp:
+			c.complete(msg.MessageId)
+		case *proto.ConnAck:
+			c.connack <- msg
+		case *proto.SubAck:
+			c.ack(msg.MessageId, msg)
+		case *proto.UnsubAck:
+			c.ack(msg.MessageId, msg)
+		case *proto.PingResp:
+			select {
+			case c.pong <- true:
+			default:
+			}
+		case *proto.Disconnect:
+			return
+		default:
+			log.Debugf("Ignoring unexpected MQTT message %T", msg)
+		}
+	}
+}
+
+// receive delivers an incoming message, acknowledging it as its QoS level requires
+func (c *clientConn) receive(msg *proto.Publish) {
+	switch msg.QosLevel {
+	case proto.QosAtLeastOnce:
+		c.Incoming <- msg
+		c.send(&proto.PubAck{MessageId: msg.MessageId})
+	case proto.QosExactlyOnce:
+		// The server will resend the message until we PUBREC it, but we must only deliver it once
+		if !c.released[msg.MessageId] {
+			c.released[msg.MessageId] = true
+			c.Incoming <- msg
+		}
+		c.send(&proto.PubRec{MessageId: msg.MessageId})
+	default:
+		c.Incoming <- msg
+	}
+}
+
+// complete forgets a QoS 1 or 2 message once the server has taken responsibility for it
+func (c *clientConn) complete(id uint16) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, msg := range c.inflight {
+		if msg.MessageId == id {
+			c.inflight = append(c.inflight[:i], c.inflight[i+1:]...)
+			return
+		}
+	}
+}
+
+// unacknowledged returns the QoS 1 and 2 messages the server never confirmed, in the order they were sent
+func (c *clientConn) unacknowledged() []*proto.Publish {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	msgs := make([]*proto.Publish, len(c.inflight))
+	copy(msgs, c.inflight)
+	return msgs
+}
+
+func (c *clientConn) ack(id uint16, msg proto.Message) {
+	c.mutex.Lock()
+	ack, ok := c.acks[id]
+	delete(c.acks, id)
+	c.mutex.Unlock()
+
+	if ok {
+		ack <- msg
+	}
+}
+
+// expectAck allocates a message id and registers interest in the matching ack
+func (c *clientConn) expectAck() (uint16, chan proto.Message, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return 0, nil, fmt.Errorf("MQTT connection is closed")
+	}
+
+	id := c.allocateID()
+	ack := make(chan proto.Message, 1)
+	c.acks[id] = ack
+	return id, ack, nil
+}
+
+// allocateID returns the next message id that isn't in use. c.mutex must be held.
+func (c *clientConn) allocateID() uint16 {
+	for {
+		c.nextID++
+		if c.nextID == 0 {
+			continue
+		}
+		if _, ok := c.acks[c.nextID]; ok {
+			continue
+		}
+		inUse := false
+		for _, msg := range c.inflight {
+			if msg.MessageId == c.nextID {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return c.nextID
+		}
+	}
+}
+
+func (c *clientConn) send(msg proto.Message) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return msg.Encode(c.conn)
+}
+
+// Connect sends the CONNECT message and waits for the server to accept it
+func (c *clientConn) Connect(msg *proto.Connect) error {
+	msg.ProtocolName = "MQIsdp"
+	msg.ProtocolVersion = 3
+	msg.ClientId = c.ClientId
+	msg.CleanSession = true
+
+	if err := c.send(msg); err != nil {
+		return err
+	}
+
+	ack, ok := <-c.connack
+	if !ok {
+		return fmt.Errorf("Connection closed before CONNACK")
+	}
+	if ack.ReturnCode != proto.RetCodeAccepted {
+		return fmt.Errorf("Connection refused by server. Return code: %d", ack.ReturnCode)
+	}
+	return nil
+}
+
+// keepAlive pings the server every interval, and closes the connection if it doesn't answer within
+// timeout. This is how we notice half-open TCP connections.
+func (c *clientConn) keepAlive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		if err := c.send(&proto.PingReq{}); err != nil {
+			return
+		}
+
+		select {
+		case <-c.pong:
+		case <-time.After(timeout):
+			log.Warningf("No PINGRESP from the mqtt server within %s. Reconnecting.", timeout)
+			c.conn.Close()
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Disconnect politely tells the server we are going away, and closes the connection
+func (c *clientConn) Disconnect() {
+	c.send(&proto.Disconnect{})
+	c.conn.Close()
+}
+
+// Subscribe subscribes to a list of topic filters, and waits for the server to acknowledge
+func (c *clientConn) Subscribe(tqs []proto.TopicQos) (*proto.SubAck, error) {
+	id, ack, err := c.expectAck()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.send(&proto.Subscribe{
+		Header:    proto.Header{QosLevel: proto.QosAtLeastOnce},
+		MessageId: id,
+		Topics:    tqs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, ok := <-ack
+	if !ok {
+		return nil, fmt.Errorf("Connection closed before SUBACK")
+	}
+	return msg.(*proto.SubAck), nil
+}
+
+// Unsubscribe removes our subscription to a list of topic filters, and waits for the server to acknowledge
+func (c *clientConn) Unsubscribe(topics []string) error {
+	id, ack, err := c.expectAck()
+	if err != nil {
+		return err
+	}
+
+	err = c.send(&proto.Unsubscribe{
+		Header:    proto.Header{QosLevel: proto.QosAtLeastOnce},
+		MessageId: id,
+		Topics:    topics,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := <-ack; !ok {
+		return fmt.Errorf("Connection closed before UNSUBACK")
+	}
+	return nil
+}
+
+// Publish sends a message to the server. QoS 1 and 2 messages are remembered until the server
+// acknowledges them.
+func (c *clientConn) Publish(msg *proto.Publish) error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return fmt.Errorf("MQTT connection is closed")
+	}
+	if msg.QosLevel != proto.QosAtMostOnce {
+		msg.MessageId = c.allocateID()
+		c.inflight = append(c.inflight, msg)
+	}
+	c.mutex.Unlock()
+
+	err := c.send(msg)
+	if err != nil && msg.QosLevel != proto.QosAtMostOnce {
+		// It never left, so it's up to the caller what to do with it
+		c.complete(msg.MessageId)
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package bus
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// newTestClientConn returns a clientConn, and the other end of its connection to play the server with
+func newTestClientConn() (*clientConn, net.Conn) {
+	client, server := net.Pipe()
+	return newClientConn(client), server
+}
+
+func TestClientConnPartialReads(t *testing.T) {
+	c, server := newTestClientConn()
+	defer server.Close()
+
+	var packets bytes.Buffer
+	(&proto.Publish{TopicName: "test/first", Payload: proto.BytesPayload([]byte("hello"))}).Encode(&packets)
+	(&proto.Publish{TopicName: "test/second", Payload: proto.BytesPayload([]byte("world"))}).Encode(&packets)
+
+	// A byte at a time, as a slow network might deliver them
+	go func() {
+		for _, b := range packets.Bytes() {
+			if _, err := server.Write([]byte{b}); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, expected := range []string{"test/first hello", "test/second world"} {
+		select {
+		case msg := <-c.Incoming:
+			if received := msg.TopicName + " " + string(msg.Payload.(proto.BytesPayload)); received != expected {
+				t.Errorf("Expected %q, got %q", expected, received)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %q", expected)
+		}
+	}
+}
+
+func TestClientConnMalformedPackets(t *testing.T) {
+	for name, packet := range map[string][]byte{
+		"reserved type":         {0x00, 0x00},
+		"topic exceeds packet":  {0x30, 0x03, 0x00, 0x09, 't'},
+		"truncated, then drops": {0x30, 0x0a, 0x00, 0x04, 't'},
+	} {
+		c, server := newTestClientConn()
+
+		// A subscribe waiting for its SUBACK must fail, rather than wait forever
+		subscribed := make(chan error, 1)
+		go func() {
+			_, err := c.Subscribe([]proto.TopicQos{{Topic: "test", Qos: proto.QosAtMostOnce}})
+			subscribed <- err
+		}()
+		if _, err := proto.DecodeOneMessage(server, nil); err != nil {
+			t.Fatalf("%s: Failed to read the SUBSCRIBE: %s", name, err)
+		}
+
+		server.Write(packet)
+		if name == "truncated, then drops" {
+			server.Close()
+		}
+
+		select {
+		case err := <-subscribed:
+			if err == nil {
+				t.Errorf("%s: Expected the subscribe to fail", name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: The subscribe never returned", name)
+		}
+
+		// The connection is dropped without delivering anything, so TinyBus reconnects
+		if msg, ok := <-c.Incoming; ok {
+			t.Errorf("%s: Unexpected message delivered: %+v", name, msg)
+		}
+		if err := c.Publish(&proto.Publish{TopicName: "test", Payload: proto.BytesPayload(nil)}); err == nil {
+			t.Errorf("%s: Expected publishing on the dropped connection to fail", name)
+		}
+
+		server.Close()
+	}
+}
@@ -0,0 +1,57 @@
+package bus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// loadTLSConfig builds the TLS configuration for the mqtt connection from the mqtt.tls.* config keys.
+// It returns nil if TLS isn't enabled.
+//
+//	mqtt.tls.enabled  - connect using TLS
+//	mqtt.tls.caFile   - PEM file of the CA(s) to trust, instead of the system roots
+//	mqtt.tls.certFile - PEM client certificate, if the server wants one
+//	mqtt.tls.keyFile  - PEM private key for the client certificate
+//	mqtt.tls.insecure - don't verify the server's certificate. Only for development!
+func loadTLSConfig() (*tls.Config, error) {
+	if !config.Bool(false, "mqtt", "tls", "enabled") {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.Bool(false, "mqtt", "tls", "insecure"),
+	}
+
+	if tlsConfig.InsecureSkipVerify {
+		log.Warningf("MQTT TLS certificate verification is disabled. Don't do this in production.")
+	}
+
+	if caFile := config.String("", "mqtt", "tls", "caFile"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read mqtt CA file %s: %s", caFile, err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in mqtt CA file %s", caFile)
+		}
+	}
+
+	certFile := config.String("", "mqtt", "tls", "certFile")
+	keyFile := config.String("", "mqtt", "tls", "keyFile")
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load mqtt client certificate %s (key: %s): %s", certFile, keyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
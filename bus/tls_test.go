@@ -0,0 +1,119 @@
+package bus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// selfSignedCert creates a certificate for 127.0.0.1, returning it along with its PEM encoding
+func selfSignedCert(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test broker"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func setenv(vars map[string]string) {
+	for k, v := range vars {
+		os.Setenv(k, v)
+	}
+	config.MustRefresh()
+}
+
+func unsetenv(vars map[string]string) {
+	for k := range vars {
+		os.Unsetenv(k)
+	}
+	config.MustRefresh()
+}
+
+func TestTinyBusTLSWithPassword(t *testing.T) {
+	cert, caPEM := selfSignedCert(t)
+
+	dir, err := ioutil.TempDir("", "tinybus-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("Failed to write CA file: %s", err)
+	}
+
+	vars := map[string]string{
+		"sphere_mqtt_tls_enabled": "true",
+		"sphere_mqtt_tls_caFile":  caFile,
+		"sphere_mqtt_username":    "sphere",
+		"sphere_mqtt_password":    "secret",
+	}
+	setenv(vars)
+	defer unsetenv(vars)
+
+	broker := newTestTLSBroker(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer broker.close()
+
+	bus, err := ConnectTinyBus(broker.addr(), "TestTinyBusTLS")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer bus.Destroy()
+
+	authenticated := broker.count(func(msg proto.Message) bool {
+		connect, ok := msg.(*proto.Connect)
+		return ok && connect.UsernameFlag && connect.Username == "sphere" &&
+			connect.PasswordFlag && connect.Password == "secret"
+	})
+
+	if authenticated != 1 {
+		t.Errorf("Expected a CONNECT with the configured username and password")
+	}
+}
+
+func TestLoadTLSConfigMissingCAFile(t *testing.T) {
+	vars := map[string]string{
+		"sphere_mqtt_tls_enabled": "true",
+		"sphere_mqtt_tls_caFile":  "/nonexistent/ca.pem",
+	}
+	setenv(vars)
+	defer unsetenv(vars)
+
+	if _, err := loadTLSConfig(); err == nil {
+		t.Errorf("Expected an error for a missing CA file")
+	}
+}
@@ -5,4 +5,7 @@ type ServiceAnnouncement struct {
 	Schema           string    `json:"schema" redis:"schema"`
 	SupportedMethods *[]string `json:"supportedMethods" redis:"supportedMethods,json"`
 	SupportedEvents  *[]string `json:"supportedEvents" redis:"supportedEvents,json"`
+	// Encoding is how the service's requests, replies and events are encoded: "json" (the default,
+	// if empty) or "cbor". Announcements are always json.
+	Encoding string `json:"encoding,omitempty" redis:"encoding"`
 }
@@ -0,0 +1,9 @@
+// Package protocols is for typed clients and server interfaces for the protocols the channels package
+// serves, generated by rpcgen. They must be generated from the schemas installed in
+// installDirectory/sphere-schemas, so run go generate where they are to write generated.go, and
+// check each channel against its server interface alongside it, e.g.
+//
+//	var _ OnOffServer = (*channels.OnOffChannel)(nil)
+package protocols
+
+//go:generate go run github.com/ninjasphere/go-ninja/schemas/rpcgen --package protocols --out generated.go --imports github.com/ninjasphere/go-ninja/channels --schemas /protocol/on-off,/protocol/brightness,/protocol/color,/protocol/transition,/protocol/identify,/protocol/media-control,/protocol/media,/protocol/volume,ThermoStat=/protocol/thermostat,HumidiStat=/protocol/humidistat,ACStat=/protocol/acstat,FanStat=/protocol/fanstat,DemandStat=/protocol/demandstat,OpenLoop=/protocol/openloop --types /protocol/brightness#/methods/set/params=float64,/protocol/thermostat#/methods/set/params=float64,/protocol/color#/methods/set/params=*channels.ColorState,/protocol/volume#/methods/set/params=*channels.VolumeState,/protocol/acstat#/methods/set/params=*channels.ACState,/protocol/fanstat#/methods/set/params=*channels.FanState,/protocol/demandstat#/methods/set/params=*channels.DemandControl,/protocol/openloop#/methods/set/params=*channels.OpenLoopState
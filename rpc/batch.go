@@ -0,0 +1,101 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ninjasphere/go-ninja/simtime"
+)
+
+// BatchClientCodec is implemented by client codecs that can send several calls in one message
+type BatchClientCodec interface {
+	EncodeClientBatch(calls []*Call) ([]byte, error)
+	// SplitBatchResponse returns the replies in a batch response. ok is false if msg isn't one.
+	SplitBatchResponse(msg []byte) (replies [][]byte, ok bool)
+}
+
+// Batch collects calls to a service, to send them in a single message. Only services that take
+// batches (e.g. those served by rpc.Server with the json2 codec) will reply to them.
+//
+//	batch := client.NewBatch(topic)
+//	on := batch.Add("turnOn", nil, nil)
+//	batch.Add("setBrightness", 0.5, nil)
+//	err := batch.Send(ctx)
+type Batch struct {
+	client *Client
+	topic  string
+	calls  []*Call
+}
+
+// NewBatch returns an empty batch of calls to the service on topic
+func (client *Client) NewBatch(topic string) *Batch {
+	return &Batch{
+		client: client,
+		topic:  topic,
+	}
+}
+
+// Add adds a call to the batch. Once the batch has been sent, the call's Error says how it went, and
+// its reply (if it succeeded) has been decoded into reply.
+func (b *Batch) Add(serviceMethod string, args interface{}, reply interface{}) *Call {
+	call := &Call{
+		ID:            b.client.newID(),
+		Topic:         b.topic,
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+	}
+	b.calls = append(b.calls, call)
+	return call
+}
+
+// Send sends the batch, and waits for the replies to all its calls until the context is done. If it is
+// done first, the calls still without a reply fail with the error CallContext would return (a
+// *TimeoutError or context.Canceled), and Send returns the first of those. Otherwise Send returns nil,
+// and each call's Error says how it went.
+func (b *Batch) Send(ctx context.Context) error {
+	codec, ok := b.client.codec.(BatchClientCodec)
+	if !ok {
+		return fmt.Errorf("The rpc codec can't send batches")
+	}
+
+	if len(b.calls) == 0 {
+		return nil
+	}
+
+	payload, err := codec.EncodeClientBatch(b.calls)
+	if err != nil {
+		return err
+	}
+
+	// There is no correlation id, the replies in the batch response are matched by their own ids
+	if err := b.client.publish(b.topic, payload, b.calls, ""); err != nil {
+		return err
+	}
+	sentTime := simtime.Now()
+
+	var errWait error
+	for _, call := range b.calls {
+		if errWait == nil {
+			select {
+			case <-call.Done:
+				continue
+			case <-ctx.Done():
+			}
+		}
+
+		if !b.client.forget(call) {
+			// The reply arrived just as we gave up
+			<-call.Done
+			continue
+		}
+
+		call.Error = waitError(ctx, call, sentTime)
+		if errWait == nil {
+			errWait = call.Error
+		}
+	}
+
+	return errWait
+}
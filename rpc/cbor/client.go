@@ -0,0 +1,121 @@
+// Copyright 2014 Ninja Blocks Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbor
+
+import (
+	"fmt"
+
+	fxcbor "github.com/fxamacker/cbor/v2"
+	"github.com/ninjasphere/go-ninja/rpc"
+	"github.com/ninjasphere/go-ninja/rpc/json2"
+)
+
+// clientRequest represents a request sent by a client.
+type clientRequest struct {
+	Method  string      `cbor:"method"`
+	Params  interface{} `cbor:"params,omitempty"`
+	ID      string      `cbor:"id"`
+	Version string      `cbor:"jsonrpc"`
+	Time    int64       `cbor:"time"`
+}
+
+// clientResponse represents a response returned to a client.
+type clientResponse struct {
+	Result fxcbor.RawMessage `cbor:"result,omitempty"`
+	Error  *json2.Error      `cbor:"error,omitempty"`
+	ID     fxcbor.RawMessage `cbor:"id"`
+}
+
+func NewClientCodec() *ClientCodec {
+	return &ClientCodec{}
+}
+
+type ClientCodec struct {
+}
+
+// EncodeClientRequest encodes parameters for a client request.
+func (c *ClientCodec) EncodeClientRequest(call *rpc.Call) ([]byte, error) {
+	return fxcbor.Marshal(&clientRequest{
+		Version: json2.Version,
+		Method:  call.ServiceMethod,
+		Params:  call.Args,
+		ID:      call.ID,
+		Time:    makeTimestamp(),
+	})
+}
+
+// DecodeIdAndError returns the id of the call a reply is for, and the error it carries. The error is a
+// *json2.Error, as it would have been from the json2 codec.
+func (c *ClientCodec) DecodeIdAndError(msg []byte) (string, error) {
+	res := &clientResponse{}
+
+	if err := decoder.Unmarshal(msg, res); err != nil {
+		return "", err
+	}
+
+	if isNull(res.ID) {
+		return "", fmt.Errorf("Reply has no id. Probably not for us")
+	}
+
+	var id string
+	if err := decoder.Unmarshal(res.ID, &id); err != nil {
+		return "", fmt.Errorf("Reply id isn't a string. Probably not for us")
+	}
+
+	if res.Error != nil {
+		return id, res.Error
+	}
+
+	return id, nil
+}
+
+// clientProgress represents a progress notification received by a client
+type clientProgress struct {
+	Method string `cbor:"method"`
+	Params *struct {
+		ID    fxcbor.RawMessage `cbor:"id"`
+		Seq   int               `cbor:"seq"`
+		Value fxcbor.RawMessage `cbor:"value"`
+	} `cbor:"params"`
+}
+
+// DecodeProgress returns the id of the call a progress notification is on, and its number
+func (c *ClientCodec) DecodeProgress(msg []byte) (string, int, bool) {
+	var progress clientProgress
+	if err := decoder.Unmarshal(msg, &progress); err != nil || progress.Method != json2.ProgressMethod || progress.Params == nil {
+		return "", 0, false
+	}
+
+	var id string
+	if err := decoder.Unmarshal(progress.Params.ID, &id); err != nil {
+		return "", 0, false
+	}
+	return id, progress.Params.Seq, true
+}
+
+// DecodeProgressValue decodes the value of a progress notification
+func (c *ClientCodec) DecodeProgressValue(msg []byte, value interface{}) error {
+	var progress clientProgress
+	if err := decoder.Unmarshal(msg, &progress); err != nil {
+		return err
+	}
+	if progress.Params == nil || isNull(progress.Params.Value) {
+		return nil
+	}
+	return decoder.Unmarshal(progress.Params.Value, value)
+}
+
+// DecodeClientResponse decodes the response body of a client request into
+// the interface reply.
+func (c *ClientCodec) DecodeClientResponse(msg []byte, reply interface{}) error {
+	res := &clientResponse{}
+	if err := decoder.Unmarshal(msg, res); err != nil {
+		return err
+	}
+	if isNull(res.Result) {
+		return nil
+	}
+	return decoder.Unmarshal(res.Result, reply)
+}
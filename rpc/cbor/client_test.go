@@ -0,0 +1,188 @@
+package cbor
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/bus"
+	"github.com/ninjasphere/go-ninja/rpc"
+	"github.com/ninjasphere/go-ninja/rpc/json2"
+)
+
+type power struct {
+	Phase int     `json:"phase"`
+	Watts float64 `json:"watts"`
+}
+
+// serve answers "read" requests with the power of the phase asked for, and fails anything else
+func serve(t *testing.T, b bus.Bus, topic string) {
+	codec := NewCodec()
+
+	b.(bus.PropertiesBus).SubscribeWithProperties(topic, nil, func(topic string, payload []byte, properties *bus.MessageProperties) {
+		if !IsMessage(payload) {
+			t.Errorf("Expected a cbor request, got %q", payload)
+		}
+
+		req, err := codec.NewRequestWithProperties(topic, payload, properties)
+		if err != nil {
+			req.WriteError(b, err)
+			return
+		}
+
+		if method, _ := req.Method(); method != "Read" {
+			req.WriteError(b, fmt.Errorf("Phase meter: %w", rpc.ErrNotSupported))
+			return
+		}
+
+		var phase int
+		if err := req.ReadRequest(&phase); err != nil {
+			req.WriteError(b, err)
+			return
+		}
+		if id := req.(rpc.RequestDescriber).ID(); id == "" {
+			t.Errorf("Expected the request to have an id")
+		}
+
+		req.WriteResponse(b, &power{Phase: phase, Watts: 230.5})
+	})
+}
+
+func TestCall(t *testing.T) {
+	for _, responseTopics := range []bool{true, false} {
+		memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+		defer memory.Destroy()
+
+		topic := fmt.Sprintf("$device/meter/channel/power-%t", responseTopics)
+		serve(t, memory, topic)
+
+		var b bus.Bus = memory
+		if !responseTopics {
+			b = &struct{ bus.Bus }{memory}
+		}
+		client := rpc.NewClient(b, NewClientCodec())
+
+		var reply power
+		if err := client.CallWithTimeout(topic, "read", 2, &reply, time.Second); err != nil {
+			t.Fatalf("Call failed: %s", err)
+		}
+		if reply != (power{Phase: 2, Watts: 230.5}) {
+			t.Errorf("Unexpected reply: %+v", reply)
+		}
+
+		err := client.CallWithTimeout(topic, "reset", nil, nil, time.Second)
+		var jsonErr *json2.Error
+		if !errors.Is(err, rpc.ErrNotSupported) || !errors.As(err, &jsonErr) || jsonErr.Message != "Phase meter: Not supported" {
+			t.Errorf("Expected a not supported error, got %#v", err)
+		}
+	}
+}
+
+func TestNotification(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	defer memory.Destroy()
+
+	notifications := make(chan []byte, 1)
+	memory.Subscribe("$device/meter/channel/power/event/state", func(topic string, payload []byte) {
+		notifications <- payload
+	})
+
+	NewCodec().SendNotification(memory, "$device/meter/channel/power/event/state", &power{Phase: 1, Watts: 10})
+
+	select {
+	case payload := <-notifications:
+		params, err := ReadNotification(payload)
+		if err != nil {
+			t.Fatalf("Failed to read notification: %s", err)
+		}
+		if fmt.Sprint(params) != "[map[phase:1 watts:10]]" {
+			t.Errorf("Unexpected params: %v", params)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No notification was sent")
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	codec := NewCodec()
+
+	if _, err := codec.NewRequest("topic", []byte(`{"jsonrpc":"2.0"}`)); err == nil {
+		t.Errorf("Expected json to be refused")
+	}
+
+	// {"jsonrpc": "2.0", "id": "1"}, with no method
+	noMethod := []byte{0xa2, 0x67, 'j', 's', 'o', 'n', 'r', 'p', 'c', 0x63, '2', '.', '0', 0x62, 'i', 'd', 0x61, '1'}
+	_, err := codec.NewRequest("topic", noMethod)
+	if jsonErr, ok := err.(*json2.Error); !ok || jsonErr.Code != json2.E_INVALID_REQ {
+		t.Errorf("Expected an invalid request error, got %#v", err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	defer memory.Destroy()
+
+	updates := make(chan []byte, 1)
+	memory.Subscribe("service/reply", func(topic string, payload []byte) {
+		updates <- payload
+	})
+
+	request, _ := NewClientCodec().EncodeClientRequest(&rpc.Call{ID: "7", ServiceMethod: "upgrade"})
+	req, err := NewCodec().NewRequest("service", request)
+	if err != nil {
+		t.Fatalf("Bad request: %s", err)
+	}
+	if err := req.(rpc.ProgressWriter).WriteProgress(memory, 3, &power{Phase: 1}); err != nil {
+		t.Fatalf("Failed to write progress: %s", err)
+	}
+
+	select {
+	case payload := <-updates:
+		codec := NewClientCodec()
+		id, seq, ok := codec.DecodeProgress(payload)
+		if !ok || id != "7" || seq != 3 {
+			t.Errorf("Unexpected progress decoded: %s %d %t", id, seq, ok)
+		}
+		var value power
+		if err := codec.DecodeProgressValue(payload, &value); err != nil || value.Phase != 1 {
+			t.Errorf("Unexpected progress value: %+v %v", value, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No progress was sent")
+	}
+}
+
+func TestEncodedResponse(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	defer memory.Destroy()
+
+	responses := make(chan map[string]interface{}, 2)
+	memory.Subscribe("service/reply", func(topic string, payload []byte) {
+		var response map[string]interface{}
+		if err := decoder.Unmarshal(payload, &response); err != nil {
+			t.Errorf("Bad response: %s", err)
+		}
+		delete(response, "time")
+		responses <- response
+	})
+
+	request, _ := NewClientCodec().EncodeClientRequest(&rpc.Call{ID: "7", ServiceMethod: "read"})
+	for _, reply := range []interface{}{&power{Phase: 1, Watts: 230.5}, nil} {
+		req, err := NewCodec().NewRequest("service", request)
+		if err != nil {
+			t.Fatalf("Bad request: %s", err)
+		}
+		req.WriteResponse(memory, reply)
+
+		encoded, err := req.(rpc.ResultEncoder).EncodeResult(reply)
+		if err != nil {
+			t.Fatalf("Failed to encode %v: %s", reply, err)
+		}
+		req.(rpc.ResultEncoder).WriteEncodedResponse(memory, encoded)
+
+		if written, rewritten := <-responses, <-responses; fmt.Sprint(written) != fmt.Sprint(rewritten) {
+			t.Errorf("Expected the encoded reply to be written as the reply was: %v, got %v", written, rewritten)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright 2014 Ninja Blocks Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cbor is a binary alternative to the json2 codec, for services whose messages are too
+// frequent for JSON. Messages are JSON-RPC 2.0 requests, responses and notifications, with the same
+// fields, errors and reply topics as json2, but encoded as CBOR (RFC 7049).
+//
+// Structs are encoded using their cbor field tags, or their json ones if they have none, so the same
+// types can be sent with either codec.
+package cbor
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	fxcbor "github.com/fxamacker/cbor/v2"
+	"github.com/ninjasphere/go-ninja/bus"
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/go-ninja/rpc"
+	"github.com/ninjasphere/go-ninja/rpc/json2"
+	"github.com/ninjasphere/go-ninja/simtime"
+)
+
+// Encoding is what services using this codec announce (see model.ServiceAnnouncement)
+const Encoding = "cbor"
+
+var log = logger.GetLogger("mqtt-cborrpc")
+
+var cborNull = []byte{0xf6}
+
+// Maps are decoded with string keys (as json would), so they can be re-encoded as JSON if needed
+var decoder, _ = fxcbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+// IsMessage reports whether a payload looks like one of our messages, i.e. a CBOR map. No JSON
+// message could start the same way.
+func IsMessage(payload []byte) bool {
+	return len(payload) > 0 && payload[0] >= 0xa0 && payload[0] <= 0xbf
+}
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// serverRequest represents a request (or notification) received by the server.
+type serverRequest struct {
+	Method  string            `cbor:"method,omitempty"`
+	Params  fxcbor.RawMessage `cbor:"params,omitempty"`
+	ID      fxcbor.RawMessage `cbor:"id,omitempty"` // Missing or null for notifications
+	Version string            `cbor:"jsonrpc"`
+	Time    int64             `cbor:"time,omitempty"`
+}
+
+// serverResponse represents a response returned by the server.
+type serverResponse struct {
+	Result  interface{}       `cbor:"result,omitempty"`
+	Error   *json2.Error      `cbor:"error,omitempty"`
+	ID      fxcbor.RawMessage `cbor:"id"`
+	Version string            `cbor:"jsonrpc"`
+	Time    int64             `cbor:"time"`
+}
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new CBOR Codec.
+func NewCodec() *Codec {
+	return &Codec{}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+}
+
+// NewRequest returns a CodecRequest.
+func (c *Codec) NewRequest(topic string, payload []byte) (rpc.CodecRequest, error) {
+	return newCodecRequest(topic, payload, nil)
+}
+
+// NewRequestWithProperties returns a CodecRequest that replies to the request's response topic, if it has one.
+func (c *Codec) NewRequestWithProperties(topic string, payload []byte, properties *bus.MessageProperties) (rpc.CodecRequest, error) {
+	return newCodecRequest(topic, payload, properties)
+}
+
+// SendNotification sends a notification
+func (c *Codec) SendNotification(client bus.Bus, topic string, payload ...interface{}) error {
+	return c.SendNotificationWithOptions(client, topic, nil, payload...)
+}
+
+// SendNotificationWithOptions sends a notification using the given QoS and retain options
+func (c *Codec) SendNotificationWithOptions(client bus.Bus, topic string, options *bus.PublishOptions, payload ...interface{}) error {
+
+	params, err := fxcbor.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Failed to marshall rpc notification: %s", err)
+	}
+
+	notification, err := fxcbor.Marshal(&serverRequest{
+		Params:  params,
+		Version: json2.Version,
+		Time:    makeTimestamp(),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to marshall rpc notification: %s", err)
+	}
+
+	log.Debugf("< Outgoing to %s : %d bytes", topic, len(notification))
+
+	client.PublishWithOptions(topic, notification, options)
+
+	return nil
+}
+
+// ReadNotification returns the params of a notification, decoded into plain values (maps with
+// string keys, slices, strings and numbers).
+func ReadNotification(payload []byte) (interface{}, error) {
+	req := new(serverRequest)
+	if err := decoder.Unmarshal(payload, req); err != nil {
+		return nil, err
+	}
+
+	var params interface{}
+	if len(req.Params) > 0 {
+		if err := decoder.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// newCodecRequest returns a new CodecRequest.
+func newCodecRequest(topic string, payload []byte, properties *bus.MessageProperties) (rpc.CodecRequest, error) {
+
+	log.Debugf("> Incoming to %s : %d bytes", topic, len(payload))
+
+	req := new(serverRequest)
+	var err error
+	if errDecode := decoder.Unmarshal(payload, req); errDecode != nil {
+		err = &json2.Error{
+			Code:    json2.E_PARSE,
+			Message: errDecode.Error(),
+		}
+		log.Infof("Bad incoming cbor-rpc request to %s error:%s", topic, err)
+	} else if req.Version != json2.Version {
+		err = &json2.Error{
+			Code:    json2.E_INVALID_REQ,
+			Message: "jsonrpc must be version " + json2.Version,
+		}
+	} else if req.Method == "" {
+		err = &json2.Error{
+			Code:    json2.E_INVALID_REQ,
+			Message: "rpc: method request ill-formed: missing method field",
+		}
+	}
+
+	return &CodecRequest{request: req, err: err, topic: topic, properties: properties}, err
+}
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	request    *serverRequest
+	err        error
+	topic      string
+	properties *bus.MessageProperties
+}
+
+// Method returns the RPC method for the current request.
+func (c *CodecRequest) Method() (string, error) {
+	if c.err == nil {
+		return upperFirst(c.request.Method), nil
+	}
+	return "", c.err
+}
+
+// ID returns the request id, or "" for a notification. Ids that aren't strings are returned in their
+// diagnostic notation (e.g. 7).
+func (c *CodecRequest) ID() string {
+	if isNull(c.request.ID) {
+		return ""
+	}
+	var id string
+	if err := decoder.Unmarshal(c.request.ID, &id); err != nil {
+		diagnostic, _ := fxcbor.Diagnose(c.request.ID)
+		return diagnostic
+	}
+	return id
+}
+
+// Time returns when the caller sent the request, or the zero time if it didn't say.
+func (c *CodecRequest) Time() time.Time {
+	if c.request.Time == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, c.request.Time*int64(time.Millisecond))
+}
+
+// ReadRequest fills the request object for the RPC method.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err == nil && !isNull(c.request.Params) {
+		if err := decoder.Unmarshal(c.request.Params, args); err != nil {
+			c.err = &json2.Error{
+				Code:    json2.E_INVALID_REQ,
+				Message: err.Error(),
+			}
+		}
+	}
+	return c.err
+}
+
+// WriteResponse encodes the response and writes it to the reply topic
+func (c *CodecRequest) WriteResponse(client bus.Bus, reply interface{}) {
+	c.writeServerResponse(client, &serverResponse{
+		Version: json2.Version,
+		Result:  reply,
+		ID:      c.request.ID,
+		Time:    makeTimestamp(),
+	})
+}
+
+// EncodeResult encodes a reply as WriteResponse would, so it can be kept and written later
+func (c *CodecRequest) EncodeResult(reply interface{}) ([]byte, error) {
+	return fxcbor.Marshal(reply)
+}
+
+// WriteEncodedResponse writes a response with a reply encoded by EncodeResult
+func (c *CodecRequest) WriteEncodedResponse(client bus.Bus, result []byte) {
+	if isNull(result) {
+		// As WriteResponse leaves out a nil reply
+		c.WriteResponse(client, nil)
+		return
+	}
+	c.WriteResponse(client, fxcbor.RawMessage(result))
+}
+
+// WriteError encodes an error, with the same codes json2 would use, and writes it to the reply topic
+func (c *CodecRequest) WriteError(client bus.Bus, err error) {
+	c.writeServerResponse(client, &serverResponse{
+		Version: json2.Version,
+		Error:   json2.AsError(err),
+		ID:      c.request.ID,
+		Time:    makeTimestamp(),
+	})
+}
+
+func (c *CodecRequest) writeServerResponse(client bus.Bus, res *serverResponse) {
+	// Notifications don't have a response
+	if isNull(c.request.ID) {
+		return
+	}
+
+	payload, err := fxcbor.Marshal(res)
+	if err != nil {
+		log.Errorf("Failed to marshall rpc response: %s", err)
+		return
+	}
+
+	rpc.PublishResponse(client, c.topic, c.properties, payload)
+}
+
+// progressParams are the params of a progress notification (see json2.ProgressMethod)
+type progressParams struct {
+	ID    fxcbor.RawMessage `cbor:"id"`
+	Seq   int               `cbor:"seq"`
+	Value interface{}       `cbor:"value"`
+}
+
+// WriteProgress sends an update on the request before its response, as json2 would but in CBOR
+func (c *CodecRequest) WriteProgress(client bus.Bus, seq int, progress interface{}) error {
+	if isNull(c.request.ID) {
+		return nil
+	}
+
+	params, err := fxcbor.Marshal(&progressParams{
+		ID:    c.request.ID,
+		Seq:   seq,
+		Value: progress,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to marshall rpc progress: %s", err)
+	}
+
+	payload, err := fxcbor.Marshal(&serverRequest{
+		Method:  json2.ProgressMethod,
+		Params:  params,
+		Version: json2.Version,
+		Time:    makeTimestamp(),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to marshall rpc progress: %s", err)
+	}
+
+	rpc.PublishResponse(client, c.topic, c.properties, payload)
+	return nil
+}
+
+func isNull(raw fxcbor.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == string(cborNull)
+}
+
+func makeTimestamp() int64 {
+	return simtime.Now().UnixNano() / int64(time.Millisecond)
+}
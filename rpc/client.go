@@ -6,12 +6,15 @@
 package rpc
 
 import (
+	"context"
+	cryptorand "crypto/rand"
 	"fmt"
-	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ninjasphere/go-ninja/bus"
+	"github.com/ninjasphere/go-ninja/config"
 	"github.com/ninjasphere/go-ninja/logger"
 	"github.com/ninjasphere/go-ninja/simtime"
 )
@@ -21,7 +24,9 @@ var log = logger.GetLogger("rpc")
 // ClientCodec encodes and decodes the calls and replies (currently, to json)
 type ClientCodec interface {
 	EncodeClientRequest(call *Call) ([]byte, error)
-	DecodeIdAndError(msg []byte) (*uint32, error)
+	// DecodeIdAndError returns the id of the call a reply is for ("" if it has none we understand),
+	// and the error it carries, if any.
+	DecodeIdAndError(msg []byte) (string, error)
 	DecodeClientResponse(msg []byte, reply interface{}) error
 }
 
@@ -33,7 +38,16 @@ type Call struct {
 	Reply         interface{} // The reply from the function (*struct).
 	Error         error       // After completion, the error status.
 	Done          chan *Call  // Strobes when call is complete.
-	ID            uint32      // Used to map responses
+	ID            string      // Used to map responses. Unique across clients (see NewClientWithID).
+
+	progress     chan *Progress // Updates waiting for the caller, nil if it doesn't want them
+	lastProgress int            // The latest update passed on. Protected by the client's mutex.
+}
+
+// ServiceCaller calls the methods of a single service. *ninja.ServiceClient is one, and it is what the
+// clients generated by rpcgen (see schemas/rpcgen) call through.
+type ServiceCaller interface {
+	CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error
 }
 
 // Client represents an RPC Client.
@@ -41,24 +55,69 @@ type Call struct {
 // with a single Client, and a Client may be used by
 // multiple goroutines simultaneously.
 type Client struct {
-	mutex      sync.Mutex // protects following
-	codec      ClientCodec
-	mqtt       bus.Bus
-	pending    map[uint32]*Call
-	subscribed map[string]bool
+	codec         ClientCodec
+	mqtt          bus.Bus
+	id            string // Prefixed to our call ids
+	responseTopic string // Our own reply topic, if the bus carries MQTT 5 properties
+
+	nextID uint64 // Accessed atomically
+
+	mutex   sync.Mutex // protects following
+	pending map[string]*Call
+
+	subscribeMutex sync.Mutex // serialises subscribing to reply topics, protects following
+	subscribed     map[string]bool
+
+	interceptorsMutex sync.Mutex // protects following
+	interceptors      []ClientInterceptor
 }
 
-// NewClient creates a new rpc client using the provided MQTT connection
+// NewClient creates a new rpc client using the provided MQTT connection. Its call ids are prefixed
+// with a random client id.
 func NewClient(mqtt bus.Bus, codec ClientCodec) *Client {
+	return NewClientWithID(mqtt, codec, "")
+}
+
+// NewClientWithID creates a new rpc client using the provided MQTT connection. Call ids are the
+// client id (usually the module's mqtt client id), a random session id, and a counter, so replies
+// can't be mistaken for those to another client, or to an earlier run of this one.
+//
+// If the connection is a bus.PropertiesBus, replies are requested on a response topic of our own
+// (with the call id as correlation data), so we don't receive every other client's replies too.
+// Set rpc.responseTopics to false if the services you call can't send replies that way. Only MemoryBus
+// is a PropertiesBus for now, so on TinyBus and PahoBus replies still come on the service's reply topic.
+func NewClientWithID(mqtt bus.Bus, codec ClientCodec, id string) *Client {
+	session := make([]byte, 4)
+	if _, err := cryptorand.Read(session); err != nil {
+		log.Warningf("Failed to read a random session id, call ids may collide: %s", err)
+	}
+
+	if id == "" {
+		id = fmt.Sprintf("%x", session)
+	} else {
+		id = fmt.Sprintf("%s.%x", id, session)
+	}
+
 	client := &Client{
-		pending:    make(map[uint32]*Call),
+		pending:    make(map[string]*Call),
 		subscribed: make(map[string]bool),
 		mqtt:       mqtt,
 		codec:      codec,
+		id:         id,
+	}
+
+	if _, ok := mqtt.(bus.PropertiesBus); ok && config.Bool(true, "rpc", "responseTopics") {
+		client.responseTopic = fmt.Sprintf("$client/%s/reply", id)
 	}
+
 	return client
 }
 
+// newID returns the id for our next call
+func (client *Client) newID() string {
+	return fmt.Sprintf("%s-%d", client.id, atomic.AddUint64(&client.nextID, 1))
+}
+
 func (client *Client) send(call *Call) error {
 
 	payload, err := client.codec.EncodeClientRequest(call)
@@ -66,48 +125,144 @@ func (client *Client) send(call *Call) error {
 		return err
 	}
 
-	if call.Done != nil {
-		replyTopic := call.Topic + "/reply"
+	return client.publish(call.Topic, payload, []*Call{call}, call.ID)
+}
 
-		if !client.subscribed[replyTopic] {
+// publish sends a message holding one or more calls. Those waiting for a reply are made pending first,
+// or a quick reply could beat them. The correlation id (if any) is sent with the message when the
+// reply is requested on our response topic.
+func (client *Client) publish(topic string, payload []byte, calls []*Call, correlationID string) error {
 
-			log.Debugf("Subscribing to %s", replyTopic)
+	awaitingReply := false
+	for _, call := range calls {
+		if call.Done != nil {
+			awaitingReply = true
+		}
+	}
 
-			_, err := client.mqtt.Subscribe(replyTopic, func(topic string, payload []byte) {
-				log.Debugf("< Incoming to %s : %s", topic, payload)
-				go client.handleResponse(topic, payload)
-			})
+	if awaitingReply {
+		if err := client.subscribeReplies(topic); err != nil {
+			return err
+		}
 
-			if err != nil {
-				return err
+		client.mutex.Lock()
+		for _, call := range calls {
+			if call.Done != nil {
+				client.pending[call.ID] = call
 			}
+		}
+		client.mutex.Unlock()
+	}
+
+	log.Debugf("< Outgoing to %s : %s", topic, payload)
 
-			client.subscribed[replyTopic] = true
+	if awaitingReply && client.responseTopic != "" {
+		properties := &bus.MessageProperties{
+			ResponseTopic: client.responseTopic,
 		}
+		if correlationID != "" {
+			properties.CorrelationData = []byte(correlationID)
+		}
+		client.mqtt.(bus.PropertiesBus).PublishWithProperties(topic, payload, nil, properties)
+	} else {
+		client.mqtt.Publish(topic, payload)
 	}
 
-	log.Debugf("< Outgoing to %s : %s", call.Topic, payload)
+	return nil
+}
+
+// forget stops waiting for a reply to a call. It returns false if a reply has already claimed the call,
+// in which case its Done channel is about to fire.
+func (client *Client) forget(call *Call) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
 
-	client.mqtt.Publish(call.Topic, payload)
+	if client.pending[call.ID] != call {
+		return false
+	}
+	delete(client.pending, call.ID)
+	return true
+}
+
+// subscribeReplies makes sure we are listening for replies to calls sent to a topic. That is either
+// our own response topic, or (if the bus can't carry properties) the shared topic + "/reply".
+func (client *Client) subscribeReplies(topic string) error {
+	replyTopic := topic + "/reply"
+	if client.responseTopic != "" {
+		replyTopic = client.responseTopic
+	}
+
+	client.subscribeMutex.Lock()
+	defer client.subscribeMutex.Unlock()
+
+	if client.subscribed[replyTopic] {
+		return nil
+	}
+
+	log.Debugf("Subscribing to %s", replyTopic)
+
+	var err error
+	if client.responseTopic != "" {
+		_, err = client.mqtt.(bus.PropertiesBus).SubscribeWithProperties(replyTopic, nil, func(topic string, payload []byte, properties *bus.MessageProperties) {
+			log.Debugf("< Incoming to %s : %s", topic, payload)
+			go client.handleResponse(topic, payload, properties)
+		})
+	} else {
+		_, err = client.mqtt.Subscribe(replyTopic, func(topic string, payload []byte) {
+			log.Debugf("< Incoming to %s : %s", topic, payload)
+			go client.handleResponse(topic, payload, nil)
+		})
+	}
 
-	if call.Done != nil {
-		client.pending[call.ID] = call
+	if err != nil {
+		return err
 	}
 
+	client.subscribed[replyTopic] = true
 	return nil
 }
 
-func (client *Client) handleResponse(topic string, payload []byte) {
+func (client *Client) handleResponse(topic string, payload []byte, properties *bus.MessageProperties) {
+	// The replies in a batch response are each handled as if they came on their own, by their own ids
+	if batchCodec, ok := client.codec.(BatchClientCodec); ok {
+		if replies, ok := batchCodec.SplitBatchResponse(payload); ok {
+			for _, reply := range replies {
+				client.handleResponse(topic, reply, nil)
+			}
+			return
+		}
+	}
+
+	// The correlation data is the call id, when the reply came back on our response topic
+	correlationID := ""
+	if properties != nil && len(properties.CorrelationData) > 0 {
+		correlationID = string(properties.CorrelationData)
+	}
+
+	if progressCodec, ok := client.codec.(ProgressClientCodec); ok {
+		if id, seq, ok := progressCodec.DecodeProgress(payload); ok {
+			if correlationID != "" {
+				id = correlationID
+			}
+			client.handleProgress(id, seq, payload)
+			return
+		}
+	}
+
 	id, err := client.codec.DecodeIdAndError(payload)
+	if correlationID != "" {
+		id = correlationID
+	}
 
-	if id == nil {
+	if id == "" {
 		log.Debugf("Failed to decode reply: %s error: %s", payload, err)
 		return
 	}
 
+	// Removing the call from pending claims it, so nobody else will touch it until call.done()
 	client.mutex.Lock()
-	call := client.pending[*id]
-	delete(client.pending, *id)
+	call := client.pending[id]
+	delete(client.pending, id)
 	client.mutex.Unlock()
 
 	if err != nil {
@@ -115,13 +270,13 @@ func (client *Client) handleResponse(topic string, payload []byte) {
 			call.Error = err
 			call.done()
 		} else {
-			log.Debugf("Ignoring error reply to call %d: %s", *id, err)
+			log.Debugf("Ignoring error reply to call %s: %s", id, err)
 		}
 		return
 	}
 
 	if call == nil {
-		log.Debugf("Ignoring reply to call %d", *id)
+		log.Debugf("Ignoring reply to call %s", id)
 		return
 	}
 
@@ -146,19 +301,31 @@ func (call *Call) done() {
 // Call invokes a function asynchronously.
 func (client *Client) Call(topic string, serviceMethod string, args interface{}) error {
 	call := &Call{
-		ID:            rand.Uint32(),
+		ID:            client.newID(),
 		Topic:         topic,
 		ServiceMethod: serviceMethod,
 		Args:          args,
 	}
 
-	return client.send(call)
+	return client.intercept(context.Background(), call, func(ctx context.Context, call *Call) error {
+		return client.send(call)
+	})
 }
 
 // CallWithTimeout invokes a function synchronously.
 func (client *Client) CallWithTimeout(topic string, serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return client.CallContext(ctx, topic, serviceMethod, args, reply)
+}
+
+// CallContext invokes a function synchronously, waiting for the reply until the context is done.
+// If the context's deadline passes first, the error is a *TimeoutError. If it is cancelled, the
+// error is context.Canceled.
+func (client *Client) CallContext(ctx context.Context, topic string, serviceMethod string, args interface{}, reply interface{}) error {
 	call := &Call{
-		ID:            rand.Uint32(),
+		ID:            client.newID(),
 		Topic:         topic,
 		ServiceMethod: serviceMethod,
 		Args:          args,
@@ -166,21 +333,92 @@ func (client *Client) CallWithTimeout(topic string, serviceMethod string, args i
 		Reply:         reply,
 	}
 
+	return client.wait(ctx, call, nil)
+}
+
+// wait sends a call (through the interceptors) and waits for its reply until the context is done,
+// passing any updates on it to onProgress meanwhile
+func (client *Client) wait(ctx context.Context, call *Call, onProgress func(*Progress)) error {
+	return client.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		return client.sendAndWait(ctx, call, onProgress)
+	})
+}
+
+func (client *Client) sendAndWait(ctx context.Context, call *Call, onProgress func(*Progress)) error {
 	err := client.send(call)
 	if err != nil {
 		return err
 	}
 	sentTime := simtime.Now()
 
-	log.Debugf("id:%d -  Waiting for reply", call.ID)
+	log.Debugf("id:%s -  Waiting for reply", call.ID)
+
+	for {
+		select {
+		case progress := <-call.progress:
+			onProgress(progress)
+		case <-call.Done:
+			log.Debugf("id:%s - Returned after %s", call.ID, time.Since(sentTime))
+			client.flushProgress(call, onProgress)
+			return call.Error
+		case <-ctx.Done():
+			if !client.forget(call) {
+				// The reply arrived just as we gave up, and is being decoded into reply. Use it.
+				<-call.Done
+				client.flushProgress(call, onProgress)
+				return call.Error
+			}
 
-	select {
-	case <-call.Done:
-		log.Debugf("id:%d - Returned after %s", call.ID, time.Since(sentTime))
-		return call.Error
-	case <-time.After(timeout):
-		delete(client.pending, call.ID)
-		return fmt.Errorf("id:%d - Call to service %s - (method: %s) timed out after %d seconds", call.ID, topic, serviceMethod, timeout/time.Second)
+			return waitError(ctx, call, sentTime)
+		}
+	}
+}
+
+// flushProgress passes on the updates that arrived before the reply, but are still waiting for the
+// caller. No more can arrive, as the call is no longer pending.
+func (client *Client) flushProgress(call *Call, onProgress func(*Progress)) {
+	for {
+		select {
+		case progress := <-call.progress:
+			onProgress(progress)
+		default:
+			return
+		}
+	}
+}
+
+// waitError is the error for a call we stopped waiting for because the context was done
+func waitError(ctx context.Context, call *Call, sentTime time.Time) error {
+	if ctx.Err() != context.DeadlineExceeded {
+		return ctx.Err()
 	}
 
+	return &TimeoutError{
+		ID:            call.ID,
+		Topic:         call.Topic,
+		ServiceMethod: call.ServiceMethod,
+		Elapsed:       time.Since(sentTime),
+	}
+}
+
+// TimeoutError is returned when a call's deadline passes before its reply arrives.
+// errors.Is(err, context.DeadlineExceeded) is true for it.
+type TimeoutError struct {
+	ID            string
+	Topic         string
+	ServiceMethod string
+	Elapsed       time.Duration // How long we waited for the reply
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("id:%s - Call to service %s - (method: %s) timed out after %s", e.ID, e.Topic, e.ServiceMethod, e.Elapsed)
+}
+
+// Timeout is always true, as for net.Error
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
 }
@@ -0,0 +1,257 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/bus"
+)
+
+// testCodec is the bare minimum of a codec: requests and replies are just {"id":...,"result":...}
+type testCodec struct{}
+
+type testMessage struct {
+	ID     string      `json:"id"`
+	Result interface{} `json:"result"`
+	Code   ErrorCode   `json:"code,omitempty"` // Set by testServerCodec if the result is a CodedError
+}
+
+func (c *testCodec) EncodeClientRequest(call *Call) ([]byte, error) {
+	return json.Marshal(&testMessage{ID: call.ID, Result: call.Args})
+}
+
+func (c *testCodec) DecodeIdAndError(msg []byte) (string, error) {
+	res := &testMessage{}
+	if err := json.Unmarshal(msg, res); err != nil {
+		return "", err
+	}
+	return res.ID, nil
+}
+
+func (c *testCodec) DecodeClientResponse(msg []byte, reply interface{}) error {
+	res := &testMessage{Result: reply}
+	return json.Unmarshal(msg, res)
+}
+
+// plainBus hides the MQTT 5 support of the bus it wraps, so replies go to topic + "/reply"
+type plainBus struct {
+	bus.Bus
+}
+
+func newTestClient(t *testing.T) (*Client, bus.Bus, func()) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "client")
+	return NewClient(&plainBus{memory}, &testCodec{}), memory, memory.Destroy
+}
+
+// echo replies to every request to topic with its args
+func echo(b bus.Bus, topic string) {
+	b.Subscribe(topic, func(topic string, payload []byte) {
+		b.Publish(topic+"/reply", payload)
+	})
+}
+
+func pendingCalls(client *Client) int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return len(client.pending)
+}
+
+func TestCallContext(t *testing.T) {
+	client, b, cleanup := newTestClient(t)
+	defer cleanup()
+
+	echo(b, "echo")
+
+	var reply string
+	if err := client.CallContext(context.Background(), "echo", "method", "hello", &reply); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	if reply != "hello" {
+		t.Errorf("Unexpected reply: %s", reply)
+	}
+}
+
+func TestCallContextDeadline(t *testing.T) {
+	client, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	err := client.CallContext(ctx, "nobody/listening", "method", nil, nil)
+
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("Expected a TimeoutError, got %v", err)
+	}
+	if timeout.Topic != "nobody/listening" || timeout.ServiceMethod != "method" {
+		t.Errorf("Unexpected timeout error: %+v", timeout)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the error to be a context.DeadlineExceeded")
+	}
+	if n := pendingCalls(client); n != 0 {
+		t.Errorf("Expected the timed out call to be forgotten, %d pending", n)
+	}
+}
+
+func TestCallContextCancel(t *testing.T) {
+	client, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*20, cancel)
+
+	if err := client.CallContext(ctx, "nobody/listening", "method", nil, nil); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if n := pendingCalls(client); n != 0 {
+		t.Errorf("Expected the cancelled call to be forgotten, %d pending", n)
+	}
+}
+
+// syncBus delivers each message to its subscribers before Publish returns, so replies are as quick as they can be
+type syncBus struct {
+	bus.Bus
+	mutex       sync.Mutex
+	subscribers map[string][]func(topic string, payload []byte)
+}
+
+func (b *syncBus) Publish(topic string, payload []byte) {
+	b.mutex.Lock()
+	subscribers := b.subscribers[topic]
+	b.mutex.Unlock()
+
+	for _, callback := range subscribers {
+		callback(topic, payload)
+	}
+}
+
+func (b *syncBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*bus.Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers[topic] = append(b.subscribers[topic], callback)
+	return &bus.Subscription{}, nil
+}
+
+func TestCallWithImmediateReply(t *testing.T) {
+	b := &syncBus{subscribers: make(map[string][]func(topic string, payload []byte))}
+	echo(b, "echo")
+
+	client := NewClient(b, &testCodec{})
+
+	for i := 0; i < 100; i++ {
+		var reply string
+		if err := client.CallWithTimeout("echo", "method", "hello", &reply, time.Second); err != nil {
+			t.Fatalf("Call %d failed: %s", i, err)
+		}
+	}
+}
+
+// Run with -race. Calls are made from many goroutines at once, to several topics, and some of them time out.
+func TestConcurrentCalls(t *testing.T) {
+	client, b, cleanup := newTestClient(t)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		echo(b, fmt.Sprintf("echo/%d", i))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 1000)
+
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if i%5 == 0 {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+					client.CallContext(ctx, "nobody/listening", "method", nil, nil)
+					cancel()
+					continue
+				}
+
+				sent := fmt.Sprintf("%d-%d", g, i)
+				var reply string
+				err := client.CallWithTimeout(fmt.Sprintf("echo/%d", i%3), "method", sent, &reply, time.Second*5)
+				if err != nil {
+					errs <- err
+				} else if reply != sent {
+					errs <- fmt.Errorf("Sent %s but got the reply %s", sent, reply)
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if n := pendingCalls(client); n != 0 {
+		t.Errorf("Expected no pending calls, %d remain", n)
+	}
+}
+
+func TestCallIDsAreUnique(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "client")
+	defer memory.Destroy()
+
+	seen := make(map[string]bool)
+	for _, client := range []*Client{
+		NewClientWithID(memory, &testCodec{}, "module"),
+		NewClientWithID(memory, &testCodec{}, "module"), // e.g. the same module after a restart
+		NewClient(memory, &testCodec{}),
+	} {
+		for i := 0; i < 100; i++ {
+			id := client.newID()
+			if seen[id] {
+				t.Fatalf("Call id %s was used twice", id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+// Clients calling the same service share its reply topic, so each must only take its own replies
+func TestClientsSharingReplyTopic(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "client")
+	defer memory.Destroy()
+	echo(memory, "echo")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+
+	for c := 0; c < 5; c++ {
+		client := NewClientWithID(&plainBus{memory}, &testCodec{}, "module")
+
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				sent := fmt.Sprintf("%d-%d", c, i)
+				var reply string
+				if err := client.CallWithTimeout("echo", "method", sent, &reply, time.Second*5); err != nil {
+					errs <- err
+				} else if reply != sent {
+					errs <- fmt.Errorf("Client %d sent %s but got the reply %s", c, sent, reply)
+				}
+			}
+		}(c)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,184 @@
+package rpc
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/bus"
+)
+
+// dedupCache remembers the requests a server has served, so that a request sent again (by a client
+// retrying, or the bus redelivering it) gets the first one's response, and the method isn't called
+// twice.
+type dedupCache struct {
+	window time.Duration // How long requests are remembered
+	size   int           // How many requests are remembered at most
+
+	mutex   sync.Mutex // protects following, and the entries' responses
+	entries map[string]*dedupEntry
+	order   []*dedupEntry // Oldest first
+}
+
+// dedupEntry is a request that has been seen. Its response is recorded once it has been written.
+type dedupEntry struct {
+	key  string
+	seen time.Time
+
+	done     bool
+	response dedupResponse
+	waiting  []CodecRequest // Duplicates that arrived before the response was recorded
+}
+
+// dedupResponse is the response written to a request
+type dedupResponse struct {
+	encoded []byte      // The reply, if the request was a ResultEncoder
+	reply   interface{} // The reply, if it wasn't
+	err     error
+}
+
+func newDedupCache(window time.Duration, size int) *dedupCache {
+	if size <= 0 {
+		size = 1
+	}
+	return &dedupCache{
+		window:  window,
+		size:    size,
+		entries: make(map[string]*dedupEntry),
+	}
+}
+
+// dedupKey returns the key a request is remembered by. Only requests with ids of the form
+// "<caller>-<n>" (as Client's are) are remembered, as others (like plain counters) can be chosen
+// alike by more than one caller. The response topic, if the request has one, is part of the key too.
+func dedupKey(topic string, properties *bus.MessageProperties, id string) (string, bool) {
+	if i := strings.LastIndex(id, "-"); i <= 0 || i == len(id)-1 {
+		return "", false
+	}
+	key := topic + "\x00" + id
+	if properties != nil && properties.ResponseTopic != "" {
+		key += "\x00" + properties.ResponseTopic
+	}
+	return key, true
+}
+
+// start returns the entry for a request. duplicate is true if it was seen within the window, in
+// which case the entry is the first one's. Requests that have expired, or that there isn't room
+// for, are forgotten first.
+func (c *dedupCache) start(key string) (entry *dedupEntry, duplicate bool) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.order) > 0 && (now.Sub(c.order[0].seen) > c.window || len(c.entries) >= c.size) {
+		if c.entries[c.order[0].key] == c.order[0] {
+			delete(c.entries, c.order[0].key)
+		}
+		c.order[0] = nil
+		c.order = c.order[1:]
+	}
+
+	if entry, ok := c.entries[key]; ok {
+		return entry, true
+	}
+
+	entry = &dedupEntry{key: key, seen: now}
+	c.entries[key] = entry
+	c.order = append(c.order, entry)
+	return entry, false
+}
+
+// replay writes the first request's response to a duplicate. If it hasn't been recorded yet, it is
+// written once it is, so the duplicate doesn't hold up a worker.
+func (c *dedupCache) replay(client bus.Bus, entry *dedupEntry, codecReq CodecRequest) {
+	c.mutex.Lock()
+	if !entry.done {
+		entry.waiting = append(entry.waiting, codecReq)
+		c.mutex.Unlock()
+		return
+	}
+	c.mutex.Unlock()
+
+	entry.response.write(client, codecReq)
+}
+
+// record records the response to an entry's request, and writes it to the duplicates waiting for it.
+// Errors worth retrying (E_BUSY and E_OFFLINE) are forgotten, so a retry is served again.
+func (c *dedupCache) record(client bus.Bus, entry *dedupEntry, response dedupResponse) {
+	c.mutex.Lock()
+	entry.done = true
+	entry.response = response
+	waiting := entry.waiting
+	entry.waiting = nil
+	if (IsCode(response.err, E_BUSY) || IsCode(response.err, E_OFFLINE)) && c.entries[entry.key] == entry {
+		delete(c.entries, entry.key)
+	}
+	c.mutex.Unlock()
+
+	for _, codecReq := range waiting {
+		response.write(client, codecReq)
+	}
+}
+
+func (r *dedupResponse) write(client bus.Bus, codecReq CodecRequest) {
+	if r.err != nil {
+		codecReq.WriteError(client, r.err)
+		return
+	}
+	if encoder, ok := codecReq.(ResultEncoder); ok && r.encoded != nil {
+		encoder.WriteEncodedResponse(client, r.encoded)
+		return
+	}
+	codecReq.WriteResponse(client, r.reply)
+}
+
+// dedupRequest records the response written to a request, so it can be replayed to duplicates
+type dedupRequest struct {
+	CodecRequest
+	describer RequestDescriber
+	cache     *dedupCache
+	entry     *dedupEntry
+	once      sync.Once
+}
+
+// WriteResponse records the reply as it is sent, if the codec can encode it first, so that a method
+// changing the reply afterwards doesn't change what duplicates are sent
+func (r *dedupRequest) WriteResponse(client bus.Bus, response interface{}) {
+	if encoder, ok := r.CodecRequest.(ResultEncoder); ok {
+		if encoded, err := encoder.EncodeResult(response); err == nil {
+			r.record(client, dedupResponse{encoded: encoded})
+			encoder.WriteEncodedResponse(client, encoded)
+			return
+		}
+	}
+	r.record(client, dedupResponse{reply: response})
+	r.CodecRequest.WriteResponse(client, response)
+}
+
+func (r *dedupRequest) WriteError(client bus.Bus, err error) {
+	r.record(client, dedupResponse{err: err})
+	r.CodecRequest.WriteError(client, err)
+}
+
+func (r *dedupRequest) record(client bus.Bus, response dedupResponse) {
+	r.once.Do(func() {
+		r.cache.record(client, r.entry, response)
+	})
+}
+
+func (r *dedupRequest) ID() string {
+	return r.describer.ID()
+}
+
+func (r *dedupRequest) Time() time.Time {
+	return r.describer.Time()
+}
+
+func (r *dedupRequest) WriteProgress(client bus.Bus, seq int, progress interface{}) error {
+	writer, ok := r.CodecRequest.(ProgressWriter)
+	if !ok {
+		return NewError(E_NOT_SUPPORTED, "The rpc codec can't send progress")
+	}
+	return writer.WriteProgress(client, seq, progress)
+}
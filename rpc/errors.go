@@ -0,0 +1,87 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorCode identifies why a method failed, so callers don't have to match on error messages
+type ErrorCode int
+
+// Standard codes for the common ways a driver can fail. Application codes are kept clear of the
+// range JSON-RPC reserves for itself (-32768 to -32000).
+const (
+	E_NOT_SUPPORTED    ErrorCode = 1000 // The device or service can't do that
+	E_BUSY             ErrorCode = 1001 // Try again later
+	E_OFFLINE          ErrorCode = 1002 // The device can't be reached
+	E_INVALID_ARGUMENT ErrorCode = 1003 // The params were well formed, but their values aren't acceptable
+)
+
+var (
+	ErrNotSupported    = &Error{Code: E_NOT_SUPPORTED, Message: "Not supported"}
+	ErrBusy            = &Error{Code: E_BUSY, Message: "Busy"}
+	ErrOffline         = &Error{Code: E_OFFLINE, Message: "Offline"}
+	ErrInvalidArgument = &Error{Code: E_INVALID_ARGUMENT, Message: "Invalid argument"}
+)
+
+// CodedError is an error that carries a code, and optionally some data, back to the caller of a
+// method. Return one (or an error wrapping one) from a method and the caller gets an error that is
+// also a CodedError, with the same code and data, whatever codec is used.
+//
+//	var coded rpc.CodedError
+//	if errors.As(err, &coded) && coded.ErrorCode() == rpc.E_OFFLINE {
+//
+// Standard codes can also be checked with errors.Is, e.g. errors.Is(err, rpc.ErrOffline).
+type CodedError interface {
+	error
+	ErrorCode() ErrorCode
+	ErrorData() interface{}
+}
+
+// Error is a simple CodedError
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Data    interface{} // Sent to the caller. It must be possible to encode it with the codec.
+}
+
+// NewError returns an error with the given code, and a message made as fmt.Sprintf would
+func NewError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+func (e *Error) ErrorData() interface{} {
+	return e.Data
+}
+
+// Is reports whether target is a CodedError with the same code
+func (e *Error) Is(target error) bool {
+	return IsCode(target, e.Code)
+}
+
+// IsCode reports whether err is, or wraps, a CodedError with the given code
+func IsCode(err error, code ErrorCode) bool {
+	var coded CodedError
+	return errors.As(err, &coded) && coded.ErrorCode() == code
+}
+
+// ValidationError is returned when a method's params or reply don't match the service's schema
+type ValidationError struct {
+	Service  string
+	Method   string
+	Section  string   // "params" or "returns"
+	Messages []string // What was wrong with them
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Method %s on %s failed validation of its %s: %s", e.Method, e.Service, e.Section, strings.Join(e.Messages, ", "))
+}
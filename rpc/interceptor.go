@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/ninjasphere/redigo/redis"
+)
+
+// ----------------------------------------------------------------------------
+// Server
+// ----------------------------------------------------------------------------
+
+// ServerInfo describes the request a ServerInterceptor is handling
+type ServerInfo struct {
+	Service string // The topic the service was registered on, which may have wildcards
+	Method  string // As in Go, e.g. SetOnOff
+	Message *Message
+	method  *serviceMethod
+}
+
+// MethodHandler calls a method (or the next interceptor) with the request's params, and returns its
+// reply, which is nil if it has none
+type MethodHandler func(ctx context.Context, params interface{}) (reply interface{}, err error)
+
+// ServerInterceptor is called around the methods of a service, once their params have been decoded
+// (and validated). It can look at or replace the params, add to the context, return early (e.g. with
+// an error, to refuse the request) or look at the reply, and calls next to carry on.
+//
+// params is what the method will be given: nil if it takes none, otherwise a value of its params'
+// type. The context is the method's (see MessageFromContext and SendProgress), even if the method
+// doesn't take it.
+type ServerInterceptor func(ctx context.Context, info *ServerInfo, params interface{}, next MethodHandler) (interface{}, error)
+
+// Use adds interceptors to every service the server serves. Interceptors are called in the order
+// they were added, and those of the server before those of the service (see ServiceOptions). Requests
+// already being served when they are added aren't intercepted by them.
+func (s *Server) Use(interceptors ...ServerInterceptor) {
+	s.interceptorsMutex.Lock()
+	defer s.interceptorsMutex.Unlock()
+	s.interceptors = append(s.interceptors[:len(s.interceptors):len(s.interceptors)], interceptors...)
+}
+
+// serviceInterceptors returns the interceptors for a service's methods, in the order they are called
+func (s *Server) serviceInterceptors(serviceSpec *service) []ServerInterceptor {
+	s.interceptorsMutex.Lock()
+	interceptors := append([]ServerInterceptor{}, s.interceptors...)
+	s.interceptorsMutex.Unlock()
+
+	return append(append(interceptors, serviceSpec.interceptors...), redisPoolInterceptor)
+}
+
+// chainServer returns a handler that calls the interceptors in order, then handler
+func chainServer(interceptors []ServerInterceptor, info *ServerInfo, handler MethodHandler) MethodHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, params interface{}) (interface{}, error) {
+			return interceptor(ctx, info, params, next)
+		}
+	}
+	return handler
+}
+
+type redisConnKey struct{}
+
+// RedisInterceptor gives the methods that take a redis.Conn one from the pool, and closes it once
+// they return. Methods are given the connection from the context, so an earlier interceptor can
+// give them another instead.
+func RedisInterceptor(pool *redis.Pool) ServerInterceptor {
+	return func(ctx context.Context, info *ServerInfo, params interface{}, next MethodHandler) (interface{}, error) {
+		if !info.method.hasRedisConn || ctx.Value(redisConnKey{}) != nil {
+			return next(ctx, params)
+		}
+
+		conn := pool.Get()
+		defer conn.Close()
+		return next(context.WithValue(ctx, redisConnKey{}, conn), params)
+	}
+}
+
+// redisPoolInterceptor is a RedisInterceptor for the pool at RedisPool, if it has been set. It is
+// the last interceptor of every service.
+func redisPoolInterceptor(ctx context.Context, info *ServerInfo, params interface{}, next MethodHandler) (interface{}, error) {
+	if RedisPool == nil {
+		return next(ctx, params)
+	}
+	return RedisInterceptor(RedisPool)(ctx, info, params, next)
+}
+
+// ----------------------------------------------------------------------------
+// Client
+// ----------------------------------------------------------------------------
+
+// Invoker sends a call (or calls the next interceptor). For calls made synchronously, it waits for
+// the reply too, which has been decoded into call.Reply if it returns nil.
+type Invoker func(ctx context.Context, call *Call) error
+
+// ClientInterceptor is called around each call a client makes (each attempt, for calls that are
+// retried). It can look at or change the call, return early, or look at the error, and calls next
+// to carry on. The calls in a Batch are sent together, without being intercepted.
+type ClientInterceptor func(ctx context.Context, call *Call, next Invoker) error
+
+// Use adds interceptors to the client's calls. They are called in the order they were added. Calls
+// already made when they are added aren't intercepted by them.
+func (client *Client) Use(interceptors ...ClientInterceptor) {
+	client.interceptorsMutex.Lock()
+	defer client.interceptorsMutex.Unlock()
+	client.interceptors = append(client.interceptors[:len(client.interceptors):len(client.interceptors)], interceptors...)
+}
+
+// intercept calls invoker for a call, through the client's interceptors
+func (client *Client) intercept(ctx context.Context, call *Call, invoker Invoker) error {
+	client.interceptorsMutex.Lock()
+	interceptors := client.interceptors
+	client.interceptorsMutex.Unlock()
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, call *Call) error {
+			return interceptor(ctx, call, next)
+		}
+	}
+	return invoker(ctx, call)
+}
@@ -7,9 +7,9 @@
 package json2
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"strconv"
 
 	"github.com/ninjasphere/go-ninja/rpc"
 )
@@ -33,6 +33,8 @@ type clientRequest struct {
 
 	// JSON-RPC protocol.
 	Version string `json:"jsonrpc"`
+
+	Time int64 `json:"time"`
 }
 
 // clientResponse represents a JSON-RPC response returned to a client.
@@ -56,7 +58,8 @@ func (c *ClientCodec) EncodeClientRequest(call *rpc.Call) ([]byte, error) {
 		Version: "2.0",
 		Method:  call.ServiceMethod,
 		Params:  []interface{}{},
-		ID:      fmt.Sprintf("%d", call.ID),
+		ID:      call.ID,
+		Time:    makeTimestamp(),
 	}
 
 	if call.Args != nil {
@@ -66,44 +69,118 @@ func (c *ClientCodec) EncodeClientRequest(call *rpc.Call) ([]byte, error) {
 	return json.Marshal(req)
 }
 
-func (c *ClientCodec) DecodeIdAndError(msg []byte) (*uint32, error) {
-	res := &clientResponse{}
+// EncodeClientBatch encodes several calls as a JSON-RPC batch request.
+func (c *ClientCodec) EncodeClientBatch(calls []*rpc.Call) ([]byte, error) {
+	batch := make([]json.RawMessage, len(calls))
+	for i, call := range calls {
+		req, err := c.EncodeClientRequest(call)
+		if err != nil {
+			return nil, err
+		}
+		batch[i] = req
+	}
+	return json.Marshal(batch)
+}
 
-	if err := json.Unmarshal(msg, res); err != nil {
-		return nil, err
+// SplitBatchResponse returns the responses in a JSON-RPC batch response.
+func (c *ClientCodec) SplitBatchResponse(msg []byte) ([][]byte, bool) {
+	trimmed := bytes.TrimLeft(msg, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return nil, false
 	}
 
-	var id uint32
-	err := json.Unmarshal(*res.ID, &id)
-	if err != nil {
+	var batch []json.RawMessage
+	if err := json.Unmarshal(msg, &batch); err != nil {
+		return nil, false
+	}
 
-		var sID string
-		err = json.Unmarshal(*res.ID, &sID)
+	replies := make([][]byte, len(batch))
+	for i, reply := range batch {
+		replies[i] = reply
+	}
+	return replies, true
+}
 
-		if err == nil {
-			var bigID uint64
-			bigID, err = strconv.ParseUint(sID, 10, 32)
-			id = uint32(bigID)
-		}
+// DecodeIdAndError returns the id of the call a reply is for, and the error it carries. String ids are
+// returned as-is, and numeric ids (from older clients) in decimal.
+func (c *ClientCodec) DecodeIdAndError(msg []byte) (string, error) {
+	res := &clientResponse{}
+
+	if err := json.Unmarshal(msg, res); err != nil {
+		return "", err
+	}
+
+	if res.ID == nil {
+		return "", fmt.Errorf("Reply has no id. Probably not for us")
 	}
 
+	id, err := decodeID(res.ID)
 	if err != nil {
-		return nil, fmt.Errorf("Reply id isn't a uint32 or string uint32. Probably not for us '%s'", *res.ID)
+		return "", err
 	}
 
 	if res.Error != nil {
 		jsonErr := &Error{}
 		if err := json.Unmarshal(*res.Error, jsonErr); err != nil {
-			return &id, &Error{
+			return id, &Error{
 				Code:    E_SERVER,
 				Message: string(*res.Error),
 			}
 		}
-		return &id, jsonErr
+		return id, jsonErr
+	}
+
+	return id, nil
+
+}
+
+// decodeID returns a reply's id. String ids are returned as-is, and numeric ids in decimal.
+func decodeID(raw *json.RawMessage) (string, error) {
+	var id string
+	if err := json.Unmarshal(*raw, &id); err != nil {
+		var number json.Number
+		if err := json.Unmarshal(*raw, &number); err != nil {
+			return "", fmt.Errorf("Reply id isn't a string or number. Probably not for us '%s'", *raw)
+		}
+		id = number.String()
 	}
+	return id, nil
+}
 
-	return &id, nil
+// clientProgress represents a progress notification received by a client
+type clientProgress struct {
+	Method string `json:"method"`
+	Params *struct {
+		ID    *json.RawMessage `json:"id"`
+		Seq   int              `json:"seq"`
+		Value *json.RawMessage `json:"value"`
+	} `json:"params"`
+}
 
+// DecodeProgress returns the id of the call an rpc.progress notification is on, and its number
+func (c *ClientCodec) DecodeProgress(msg []byte) (string, int, bool) {
+	var progress clientProgress
+	if err := json.Unmarshal(msg, &progress); err != nil || progress.Method != ProgressMethod || progress.Params == nil || progress.Params.ID == nil {
+		return "", 0, false
+	}
+
+	id, err := decodeID(progress.Params.ID)
+	if err != nil {
+		return "", 0, false
+	}
+	return id, progress.Params.Seq, true
+}
+
+// DecodeProgressValue decodes the value of an rpc.progress notification
+func (c *ClientCodec) DecodeProgressValue(msg []byte, value interface{}) error {
+	var progress clientProgress
+	if err := json.Unmarshal(msg, &progress); err != nil {
+		return err
+	}
+	if progress.Params == nil || progress.Params.Value == nil {
+		return nil
+	}
+	return json.Unmarshal(*progress.Params.Value, value)
 }
 
 // DecodeClientResponse decodes the response body of a client request into
@@ -0,0 +1,458 @@
+package json2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/bus"
+	"github.com/ninjasphere/go-ninja/rpc"
+)
+
+// plainBus hides the MQTT 5 support of the bus it wraps, like an older broker would
+type plainBus struct {
+	bus.Bus
+}
+
+// serveEcho answers every request to topic with its own method name, except "fail", which fails.
+// It takes batches too.
+func serveEcho(t *testing.T, b bus.Bus, topic string) {
+	codec := NewCodec()
+
+	handle := func(topic string, payload []byte, properties *bus.MessageProperties) {
+		var requests []rpc.CodecRequest
+		if codec.IsBatch(payload) {
+			var err error
+			if requests, err = codec.NewBatchRequest(topic, payload, properties); err != nil {
+				t.Errorf("Bad batch: %s", err)
+				return
+			}
+		} else {
+			req, err := codec.NewRequestWithProperties(topic, payload, properties)
+			if err != nil {
+				t.Errorf("Bad request: %s", err)
+				return
+			}
+			requests = append(requests, req)
+		}
+
+		for _, req := range requests {
+			if method, _ := req.Method(); method == "Fail" {
+				req.WriteError(b, rpc.ErrBusy)
+			} else {
+				req.WriteResponse(b, method)
+			}
+		}
+	}
+
+	var err error
+	if propertiesBus, ok := b.(bus.PropertiesBus); ok {
+		_, err = propertiesBus.SubscribeWithProperties(topic, nil, handle)
+	} else {
+		_, err = b.Subscribe(topic, func(topic string, payload []byte) {
+			handle(topic, payload, nil)
+		})
+	}
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+	}
+}
+
+// watchReplies counts messages published to the shared reply topic
+func watchReplies(b bus.Bus, topic string) chan bool {
+	replies := make(chan bool, 10)
+	b.Subscribe(topic+"/reply", func(topic string, payload []byte) {
+		replies <- true
+	})
+	return replies
+}
+
+func TestClientUsesResponseTopic(t *testing.T) {
+	server, _ := bus.ConnectMemoryBus("TestClientUsesResponseTopic", "server")
+	defer server.Destroy()
+	caller, _ := bus.ConnectMemoryBus("TestClientUsesResponseTopic", "caller")
+	defer caller.Destroy()
+	other, _ := bus.ConnectMemoryBus("TestClientUsesResponseTopic", "other")
+	defer other.Destroy()
+
+	topic := "$device/1/channel/test"
+	serveEcho(t, server, topic)
+	replies := watchReplies(other, topic)
+
+	client := rpc.NewClient(caller, NewClientCodec())
+
+	var reply string
+	if err := client.CallWithTimeout(topic, "ping", nil, &reply, time.Second); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	if reply != "Ping" {
+		t.Errorf("Unexpected reply: %s", reply)
+	}
+
+	select {
+	case <-replies:
+		t.Errorf("Reply was broadcast on the shared reply topic")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestClientFallsBackToReplyTopic(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus("TestClientFallsBackToReplyTopic", "server")
+	defer memory.Destroy()
+	server := &plainBus{memory}
+
+	memory, _ = bus.ConnectMemoryBus("TestClientFallsBackToReplyTopic", "caller")
+	defer memory.Destroy()
+	caller := &plainBus{memory}
+
+	topic := "$device/1/channel/test"
+	serveEcho(t, server, topic)
+	replies := watchReplies(caller, topic)
+
+	client := rpc.NewClient(caller, NewClientCodec())
+
+	var reply string
+	if err := client.CallWithTimeout(topic, "ping", nil, &reply, time.Second); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	if reply != "Ping" {
+		t.Errorf("Unexpected reply: %s", reply)
+	}
+
+	select {
+	case <-replies:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the reply on the shared reply topic")
+	}
+}
+
+func TestDecodeIdAndError(t *testing.T) {
+	codec := NewClientCodec()
+
+	for msg, expected := range map[string]string{
+		`{"jsonrpc":"2.0","id":"module.1a2b3c4d-7","result":null}`: "module.1a2b3c4d-7",
+		`{"jsonrpc":"2.0","id":3735928559,"result":null}`:          "3735928559",
+		`{"jsonrpc":"2.0","id":"42","result":null}`:                "42",
+	} {
+		id, err := codec.DecodeIdAndError([]byte(msg))
+		if err != nil {
+			t.Errorf("Failed to decode %s: %s", msg, err)
+		}
+		if id != expected {
+			t.Errorf("Expected id %s, got %s", expected, id)
+		}
+	}
+
+	id, err := codec.DecodeIdAndError([]byte(`{"jsonrpc":"2.0","id":"x-1","error":{"code":-32000,"message":"Oops"}}`))
+	if id != "x-1" || err == nil || err.(*Error).Message != "Oops" {
+		t.Errorf("Expected the id and error, got %s %v", id, err)
+	}
+
+	if id, err := codec.DecodeIdAndError([]byte(`{"jsonrpc":"2.0","method":"notification"}`)); id != "" || err == nil {
+		t.Errorf("Expected no id and an error for a message without an id, got %s %v", id, err)
+	}
+}
+
+func TestCodecRequestDescribesRequest(t *testing.T) {
+	sent := time.Now()
+	payload, _ := NewClientCodec().EncodeClientRequest(&rpc.Call{ID: "client-1", ServiceMethod: "method"})
+
+	req, err := NewCodec().NewRequest("topic", payload)
+	if err != nil {
+		t.Fatalf("Bad request: %s", err)
+	}
+
+	describer := req.(rpc.RequestDescriber)
+	if id := describer.ID(); id != "client-1" {
+		t.Errorf("Unexpected id: %s", id)
+	}
+	if at := describer.Time(); at.Before(sent.Add(-time.Second)) || at.After(time.Now()) {
+		t.Errorf("Unexpected time: %s", at)
+	}
+
+	req, _ = NewCodec().NewRequest("topic", []byte(`{"jsonrpc":"2.0","method":"method","id":7}`))
+	if id := req.(rpc.RequestDescriber).ID(); id != "7" {
+		t.Errorf("Unexpected numeric id: %s", id)
+	}
+	if at := req.(rpc.RequestDescriber).Time(); !at.IsZero() {
+		t.Errorf("Expected no time, got %s", at)
+	}
+}
+
+func TestServerErrorCodes(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	defer memory.Destroy()
+
+	replies := make(chan []byte, 1)
+	memory.Subscribe("topic/reply", func(topic string, payload []byte) {
+		replies <- payload
+	})
+
+	for _, test := range []struct {
+		err  error
+		code ErrorCode
+	}{
+		{&rpc.PanicError{Service: "topic", Method: "Method", Value: "boom"}, E_INTERNAL},
+		{&rpc.ValidationError{Service: "topic", Method: "Method", Section: "params"}, E_BAD_PARAMS},
+		{&rpc.ValidationError{Service: "topic", Method: "Method", Section: "returns"}, E_INTERNAL},
+	} {
+		req, _ := NewCodec().NewRequest("topic", []byte(`{"jsonrpc":"2.0","method":"method","id":"1"}`))
+		req.WriteError(&plainBus{memory}, test.err)
+
+		select {
+		case reply := <-replies:
+			_, err := NewClientCodec().DecodeIdAndError(reply)
+			if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != test.code {
+				t.Errorf("Expected code %d for %T, got %#v", test.code, test.err, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No reply was sent")
+		}
+	}
+}
+
+func TestCodedErrorsReachTheCaller(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	defer memory.Destroy()
+
+	type retry struct {
+		After int `json:"after"`
+	}
+
+	topic := "$device/1/channel/light"
+	codec := NewCodec()
+	memory.SubscribeWithProperties(topic, nil, func(topic string, payload []byte, properties *bus.MessageProperties) {
+		req, _ := codec.NewRequestWithProperties(topic, payload, properties)
+		offline := &rpc.Error{Code: rpc.E_OFFLINE, Message: "Offline", Data: &retry{After: 30}}
+		req.WriteError(memory, fmt.Errorf("Lamp didn't answer: %w", offline))
+	})
+
+	client := rpc.NewClient(memory, NewClientCodec())
+	err := client.CallWithTimeout(topic, "turnOn", nil, nil, time.Second)
+
+	var coded rpc.CodedError
+	if !errors.As(err, &coded) || coded.ErrorCode() != rpc.E_OFFLINE {
+		t.Fatalf("Expected an offline error, got %#v", err)
+	}
+	if err.Error() != "Lamp didn't answer: Offline" {
+		t.Errorf("Unexpected message: %s", err)
+	}
+	if !errors.Is(err, rpc.ErrOffline) || errors.Is(err, rpc.ErrBusy) {
+		t.Errorf("Expected errors.Is to match on the code")
+	}
+
+	var data retry
+	if err := err.(*Error).DecodeData(&data); err != nil || data.After != 30 {
+		t.Errorf("Unexpected data: %+v (%v)", data, err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	for _, responseTopics := range []bool{true, false} {
+		memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+		defer memory.Destroy()
+
+		var b bus.Bus = memory
+		if !responseTopics {
+			b = &plainBus{memory}
+		}
+
+		topic := "$device/1/channel/test"
+		serveEcho(t, b, topic)
+
+		client := rpc.NewClient(b, NewClientCodec())
+		batch := client.NewBatch(topic)
+
+		var ping, pong string
+		pingCall := batch.Add("ping", nil, &ping)
+		failCall := batch.Add("fail", nil, nil)
+		pongCall := batch.Add("pong", []string{"args"}, &pong)
+
+		if err := batch.Send(context.Background()); err != nil {
+			t.Fatalf("Batch failed: %s", err)
+		}
+
+		if pingCall.Error != nil || ping != "Ping" || pongCall.Error != nil || pong != "Pong" {
+			t.Errorf("Unexpected replies: %s (%v), %s (%v)", ping, pingCall.Error, pong, pongCall.Error)
+		}
+		if !errors.Is(failCall.Error, rpc.ErrBusy) {
+			t.Errorf("Expected the failed call to be busy, got %v", failCall.Error)
+		}
+	}
+}
+
+func TestBatchTimeout(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "client")
+	defer memory.Destroy()
+
+	client := rpc.NewClient(memory, NewClientCodec())
+	batch := client.NewBatch("nobody/listening")
+	first := batch.Add("first", nil, nil)
+	second := batch.Add("second", nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	var timeout *rpc.TimeoutError
+	if err := batch.Send(ctx); !errors.As(err, &timeout) || timeout.ServiceMethod != "first" {
+		t.Errorf("Expected the first call to time out, got %v", err)
+	}
+	if !errors.As(second.Error, &timeout) || timeout.ServiceMethod != "second" || first.Error == nil {
+		t.Errorf("Expected both calls to have timed out, got %v and %v", first.Error, second.Error)
+	}
+}
+
+func TestBatchResponse(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	defer memory.Destroy()
+
+	responses := make(chan string, 10)
+	memory.Subscribe("topic/reply", func(topic string, payload []byte) {
+		responses <- string(payload)
+	})
+
+	for _, test := range []struct {
+		batch    string
+		response string
+	}{
+		{`[{"jsonrpc":"2.0","method":"a","id":"1"},{"jsonrpc":"2.0","method":"b"},{"jsonrpc":"2.0","id":"3"},{"jsonrpc":"2.0","method":"d","id":4}]`,
+			`[{"result":"A","id":"1","jsonrpc":"2.0","time":0},{"error":{"code":-32600,"message":"rpc: method request ill-formed: missing method field","data":{"params":null,"id":"3","jsonrpc":"2.0","time":0}},"id":"3","jsonrpc":"2.0","time":0},{"result":"D","id":4,"jsonrpc":"2.0","time":0}]`},
+		// Notifications have no response, so neither does a batch of them
+		{`[{"jsonrpc":"2.0","method":"a"},{"jsonrpc":"2.0","method":"b"}]`, ""},
+		// Elements that aren't requests are answered, even without an id
+		{`[1,{"jsonrpc":"2.0","params":[]}]`,
+			`[{"error":{"code":-32600,"message":"json: cannot unmarshal number into Go value of type json2.serverRequest","data":{"params":null,"jsonrpc":"","time":0}},"id":null,"jsonrpc":"2.0","time":0},{"error":{"code":-32600,"message":"rpc: method request ill-formed: missing method field","data":{"params":[],"jsonrpc":"2.0","time":0}},"id":null,"jsonrpc":"2.0","time":0}]`},
+	} {
+		requests, err := NewCodec().NewBatchRequest("topic", []byte(test.batch), nil)
+		if err != nil {
+			t.Fatalf("Bad batch: %s", err)
+		}
+		for _, req := range requests {
+			if method, err := req.Method(); err != nil {
+				req.WriteError(&plainBus{memory}, err)
+			} else {
+				req.WriteResponse(&plainBus{memory}, method)
+			}
+		}
+
+		select {
+		case response := <-responses:
+			// Blank out the timestamps
+			response = regexp.MustCompile(`"time":\d+`).ReplaceAllString(response, `"time":0`)
+			if response != test.response {
+				t.Errorf("Unexpected response: %s", response)
+			}
+		case <-time.After(time.Millisecond * 100):
+			if test.response != "" {
+				t.Errorf("No response was sent")
+			}
+		}
+	}
+
+	_, err := NewCodec().NewBatchRequest("topic", []byte(`[]`), nil)
+	if err == nil {
+		t.Fatalf("Expected an empty batch to be refused")
+	}
+
+	// The server answers a batch it can't read with a single error, as the request it couldn't decode
+	req, _ := NewCodec().NewRequest("topic", []byte(`[]`))
+	req.WriteError(&plainBus{memory}, err)
+	select {
+	case response := <-responses:
+		response = regexp.MustCompile(`"time":\d+`).ReplaceAllString(response, `"time":0`)
+		if response != `{"error":{"code":-32600,"message":"Empty batch","data":null},"id":null,"jsonrpc":"2.0","time":0}` {
+			t.Errorf("Unexpected response to a bad batch: %s", response)
+		}
+	case <-time.After(time.Millisecond * 100):
+		t.Errorf("No response was sent to a bad batch")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	defer memory.Destroy()
+
+	type update struct {
+		payload    []byte
+		properties *bus.MessageProperties
+	}
+	updates := make(chan update, 1)
+	memory.SubscribeWithProperties("$client/abc/reply", nil, func(topic string, payload []byte, properties *bus.MessageProperties) {
+		updates <- update{payload, properties}
+	})
+
+	req, err := NewCodec().NewRequestWithProperties("service", []byte(`{"jsonrpc":"2.0","method":"upgrade","id":"7"}`), &bus.MessageProperties{
+		ResponseTopic:   "$client/abc/reply",
+		CorrelationData: []byte("abc-7"),
+	})
+	if err != nil {
+		t.Fatalf("Bad request: %s", err)
+	}
+	if err := req.(rpc.ProgressWriter).WriteProgress(memory, 2, map[string]int{"percent": 50}); err != nil {
+		t.Fatalf("Failed to write progress: %s", err)
+	}
+
+	var received update
+	select {
+	case received = <-updates:
+	case <-time.After(time.Second):
+		t.Fatalf("No progress was sent")
+	}
+
+	if !regexp.MustCompile(`^{"method":"rpc.progress","params":{"id":"7","seq":2,"value":{"percent":50}},"jsonrpc":"2.0","time":\d+}$`).Match(received.payload) {
+		t.Errorf("Unexpected progress: %s", received.payload)
+	}
+	if string(received.properties.CorrelationData) != "abc-7" {
+		t.Errorf("Expected the request's correlation data, got %q", received.properties.CorrelationData)
+	}
+
+	codec := NewClientCodec()
+	id, seq, ok := codec.DecodeProgress(received.payload)
+	if !ok || id != "7" || seq != 2 {
+		t.Errorf("Unexpected progress decoded: %s %d %t", id, seq, ok)
+	}
+	var value struct{ Percent int }
+	if err := codec.DecodeProgressValue(received.payload, &value); err != nil || value.Percent != 50 {
+		t.Errorf("Unexpected progress value: %+v %v", value, err)
+	}
+
+	// Clients that don't know about progress ignore it, as it has no id
+	if id, _ := codec.DecodeIdAndError(received.payload); id != "" {
+		t.Errorf("Expected progress to have no reply id, got %s", id)
+	}
+	if _, _, ok := codec.DecodeProgress([]byte(`{"jsonrpc":"2.0","id":"7","result":"done"}`)); ok {
+		t.Errorf("Expected a reply not to be taken for progress")
+	}
+}
+
+func TestEncodedResponse(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	defer memory.Destroy()
+
+	responses := make(chan string, 2)
+	memory.Subscribe("topic/reply", func(topic string, payload []byte) {
+		// Blank out the timestamp
+		responses <- regexp.MustCompile(`"time":\d+`).ReplaceAllString(string(payload), `"time":0`)
+	})
+
+	for _, reply := range []interface{}{map[string]int{"level": 3}, nil} {
+		req, err := NewCodec().NewRequest("topic", []byte(`{"jsonrpc":"2.0","method":"get","id":"1"}`))
+		if err != nil {
+			t.Fatalf("Bad request: %s", err)
+		}
+		req.WriteResponse(&plainBus{memory}, reply)
+
+		encoded, err := req.(rpc.ResultEncoder).EncodeResult(reply)
+		if err != nil {
+			t.Fatalf("Failed to encode %v: %s", reply, err)
+		}
+		req.(rpc.ResultEncoder).WriteEncodedResponse(&plainBus{memory}, encoded)
+
+		if written, rewritten := <-responses, <-responses; written != rewritten {
+			t.Errorf("Expected the encoded reply to be written as the reply was: %s, got %s", written, rewritten)
+		}
+	}
+}
@@ -5,6 +5,13 @@
 
 package json2
 
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/ninjasphere/go-ninja/rpc"
+)
+
 type ErrorCode int
 
 const (
@@ -31,3 +38,57 @@ type Error struct {
 func (e *Error) Error() string {
 	return e.Message
 }
+
+// ErrorCode makes Error an rpc.CodedError, so callers needn't know which codec a service uses
+func (e *Error) ErrorCode() rpc.ErrorCode {
+	return rpc.ErrorCode(e.Code)
+}
+
+func (e *Error) ErrorData() interface{} {
+	return e.Data
+}
+
+// Is reports whether target is an rpc.CodedError with the same code, e.g. errors.Is(err, rpc.ErrOffline)
+func (e *Error) Is(target error) bool {
+	return rpc.IsCode(target, rpc.ErrorCode(e.Code))
+}
+
+// DecodeData fills v with the error's data. In an error returned to a client, Data has been decoded
+// into plain maps and slices, this decodes it into the type the service sent.
+func (e *Error) DecodeData(v interface{}) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// AsError returns an error as a JSON-RPC error object. Errors from the rpc package, and rpc.CodedErrors,
+// get the codes they call for, anything else is an E_SERVER.
+func AsError(err error) *Error {
+	if jsonErr, ok := err.(*Error); ok {
+		return jsonErr
+	}
+
+	jsonErr := &Error{
+		Code:    E_SERVER,
+		Message: err.Error(),
+	}
+
+	var coded rpc.CodedError
+	if errors.As(err, &coded) {
+		jsonErr.Code = ErrorCode(coded.ErrorCode())
+		jsonErr.Data = coded.ErrorData()
+	} else if _, ok := err.(*rpc.PanicError); ok {
+		jsonErr.Code = E_INTERNAL
+	} else if validationErr, ok := err.(*rpc.ValidationError); ok {
+		// Bad params are the caller's fault, a bad reply is ours
+		jsonErr.Code = E_INTERNAL
+		if validationErr.Section == "params" {
+			jsonErr.Code = E_BAD_PARAMS
+		}
+		jsonErr.Data = validationErr.Messages
+	}
+
+	return jsonErr
+}
@@ -7,9 +7,11 @@
 package json2
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ninjasphere/go-ninja/bus"
@@ -84,11 +86,70 @@ type Codec struct {
 
 // NewRequest returns a CodecRequest.
 func (c *Codec) NewRequest(topic string, payload []byte) (rpc.CodecRequest, error) {
-	return newCodecRequest(topic, payload)
+	return newCodecRequest(topic, payload, nil)
+}
+
+// NewRequestWithProperties returns a CodecRequest that replies to the request's response topic, if it has one.
+func (c *Codec) NewRequestWithProperties(topic string, payload []byte, properties *bus.MessageProperties) (rpc.CodecRequest, error) {
+	return newCodecRequest(topic, payload, properties)
+}
+
+// IsBatch reports whether a payload is a JSON array, i.e. a batch of requests
+func (c *Codec) IsBatch(payload []byte) bool {
+	trimmed := bytes.TrimLeft(payload, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// NewBatchRequest returns the requests in a batch. Their responses are sent together, as an array,
+// once they have all been written. Notifications in the batch have no response, and if the batch is
+// all notifications, nothing is sent. Elements that aren't valid requests are answered with an
+// invalid request error, with a null id if they don't have one.
+func (c *Codec) NewBatchRequest(topic string, payload []byte, properties *bus.MessageProperties) ([]rpc.CodecRequest, error) {
+
+	log.Debugf("> Incoming batch to %s : %s", topic, payload)
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, &Error{
+			Code:    E_PARSE,
+			Message: err.Error(),
+		}
+	}
+
+	if len(raw) == 0 {
+		return nil, &Error{
+			Code:    E_INVALID_REQ,
+			Message: "Empty batch",
+		}
+	}
+
+	batch := &batchResponse{
+		topic:      topic,
+		properties: properties,
+		remaining:  len(raw),
+	}
+
+	requests := make([]rpc.CodecRequest, len(raw))
+	for i, r := range raw {
+		req, err := decodeRequest(topic, r, properties)
+		if jsonErr, ok := err.(*Error); ok && jsonErr.Code == E_PARSE {
+			// The batch parsed, so the element just isn't a request object
+			jsonErr.Code = E_INVALID_REQ
+		}
+		req.batch = batch
+		requests[i] = req
+	}
+
+	return requests, nil
 }
 
 // SendNotification sends a JSON-RPC notification
 func (c *Codec) SendNotification(client bus.Bus, topic string, payload ...interface{}) error {
+	return c.SendNotificationWithOptions(client, topic, nil, payload...)
+}
+
+// SendNotificationWithOptions sends a JSON-RPC notification using the given QoS and retain options
+func (c *Codec) SendNotificationWithOptions(client bus.Bus, topic string, options *bus.PublishOptions, payload ...interface{}) error {
 
 	notification := &serverRequest{
 		Version: Version,
@@ -109,7 +170,7 @@ func (c *Codec) SendNotification(client bus.Bus, topic string, payload ...interf
 		log.Debugf("< Outgoing to %s : %s", topic, jsonNotification)
 	}
 
-	client.Publish(topic, jsonNotification)
+	client.PublishWithOptions(topic, jsonNotification, options)
 
 	return nil
 }
@@ -119,10 +180,16 @@ func (c *Codec) SendNotification(client bus.Bus, topic string, payload ...interf
 // ----------------------------------------------------------------------------
 
 // newCodecRequest returns a new CodecRequest.
-func newCodecRequest(topic string, payload []byte) (rpc.CodecRequest, error) {
+func newCodecRequest(topic string, payload []byte, properties *bus.MessageProperties) (rpc.CodecRequest, error) {
 
 	log.Debugf("> Incoming to %s : %s", topic, payload)
 
+	return decodeRequest(topic, payload, properties)
+}
+
+// decodeRequest decodes a single request
+func decodeRequest(topic string, payload []byte, properties *bus.MessageProperties) (*CodecRequest, error) {
+
 	// Decode the request body and check if RPC method is valid.
 	req := new(serverRequest)
 	err := json.Unmarshal(payload, req)
@@ -133,6 +200,12 @@ func newCodecRequest(topic string, payload []byte) (rpc.CodecRequest, error) {
 			Data:    req,
 		}
 		log.Infof("Bad incoming json-rpc request to %s error:%s json:%s ", topic, err, payload)
+	} else if req.Method == nil {
+		err = &Error{
+			Code:    E_INVALID_REQ,
+			Message: "rpc: method request ill-formed: missing method field",
+			Data:    req,
+		}
 	} else {
 		method := upperFirst(*req.Method)
 
@@ -146,14 +219,50 @@ func newCodecRequest(topic string, payload []byte) (rpc.CodecRequest, error) {
 			}
 		}
 	}
-	return &CodecRequest{request: req, err: err, topic: topic}, err
+	return &CodecRequest{request: req, err: err, topic: topic, properties: properties}, err
 }
 
 // CodecRequest decodes and encodes a single request.
 type CodecRequest struct {
-	request *serverRequest
-	err     error
-	topic   string
+	request    *serverRequest
+	err        error
+	topic      string
+	properties *bus.MessageProperties
+	batch      *batchResponse // Collects the response, if the request was part of a batch
+}
+
+// batchResponse collects the responses to the requests in a batch
+type batchResponse struct {
+	topic      string
+	properties *bus.MessageProperties
+
+	mutex     sync.Mutex // protects following
+	remaining int        // Requests yet to write their response
+	responses []*serverResponse
+}
+
+// add collects the response to one of the batch's requests (nil for a notification), and sends the
+// batch's responses once they are all in.
+func (b *batchResponse) add(client bus.Bus, res *serverResponse) {
+	b.mutex.Lock()
+	if res != nil {
+		b.responses = append(b.responses, res)
+	}
+	b.remaining--
+	done := b.remaining == 0
+	b.mutex.Unlock()
+
+	if !done || len(b.responses) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(b.responses)
+	if err != nil {
+		log.Errorf("Failed to marshall rpc batch response: %s", err)
+		return
+	}
+
+	rpc.PublishResponse(client, b.topic, b.properties, payload)
 }
 
 // Method returns the RPC method for the current request.
@@ -166,6 +275,27 @@ func (c *CodecRequest) Method() (string, error) {
 	return "", c.err
 }
 
+// ID returns the request id, or "" for a notification. String ids are returned as-is, and others as
+// their JSON.
+func (c *CodecRequest) ID() string {
+	if c.request.ID == nil {
+		return ""
+	}
+	var id string
+	if err := json.Unmarshal(*c.request.ID, &id); err != nil {
+		return string(*c.request.ID)
+	}
+	return id
+}
+
+// Time returns when the caller sent the request, or the zero time if it didn't say.
+func (c *CodecRequest) Time() time.Time {
+	if c.request.Time == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, c.request.Time*int64(time.Millisecond))
+}
+
 // ReadRequest fills the request object for the RPC method.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
 	if c.err == nil {
@@ -240,17 +370,20 @@ func (c *CodecRequest) WriteResponse(client bus.Bus, reply interface{}) {
 	c.writeServerResponse(client, res)
 }
 
+// EncodeResult encodes a reply as WriteResponse would, so it can be kept and written later
+func (c *CodecRequest) EncodeResult(reply interface{}) ([]byte, error) {
+	return json.Marshal(reply)
+}
+
+// WriteEncodedResponse writes a response with a reply encoded by EncodeResult
+func (c *CodecRequest) WriteEncodedResponse(client bus.Bus, result []byte) {
+	c.WriteResponse(client, json.RawMessage(result))
+}
+
 func (c *CodecRequest) WriteError(client bus.Bus, err error) {
-	jsonErr, ok := err.(*Error)
-	if !ok {
-		jsonErr = &Error{
-			Code:    E_SERVER,
-			Message: err.Error(),
-		}
-	}
 	res := &serverResponse{
 		Version: Version,
-		Error:   jsonErr,
+		Error:   AsError(err),
 		ID:      c.request.ID,
 		Time:    makeTimestamp(),
 	}
@@ -258,26 +391,77 @@ func (c *CodecRequest) WriteError(client bus.Bus, err error) {
 }
 
 func (c *CodecRequest) writeServerResponse(client bus.Bus, res *serverResponse) {
-	// Id is null for notifications and they don't have a response.
+	// Id is null for notifications and they don't have a response. Requests that couldn't be
+	// decoded are answered anyway, with a null id if they didn't have one.
 
-	if c.request.ID != nil {
+	if c.batch != nil {
+		if c.request.ID == nil && c.err == nil {
+			res = nil
+		}
+		c.batch.add(client, res)
+		return
+	}
 
-		payload, err := json.Marshal(res)
+	if c.request.ID != nil || c.err != nil {
 
-		log.Debugf("< Outgoing to %s : %s", c.topic+"/reply", payload)
+		payload, err := json.Marshal(res)
 
 		if err != nil {
 			log.Errorf("Failed to marshall rpc response: %s", err)
 			return
 		}
 
-		client.Publish(c.topic+"/reply", payload)
+		rpc.PublishResponse(client, c.topic, c.properties, payload)
+	}
+}
 
-		if err != nil {
-			log.Errorf("Failed to write rpc response to MQTT: %s", err)
-			return
-		}
+// ProgressMethod is the method of the notifications that carry progress on a request. JSON-RPC
+// reserves the methods starting with "rpc." for extensions like this.
+const ProgressMethod = "rpc.progress"
+
+// progressParams are the params of a progress notification
+type progressParams struct {
+	ID    *json.RawMessage `json:"id"`  // The request the progress is on
+	Seq   int              `json:"seq"` // Numbered from 1
+	Value interface{}      `json:"value"`
+}
+
+// WriteProgress sends an update on the request before its response, as an rpc.progress notification to
+// wherever the response will go. Updates on requests in a batch are sent straight away, on their own.
+func (c *CodecRequest) WriteProgress(client bus.Bus, seq int, progress interface{}) error {
+	if c.request.ID == nil {
+		return nil
+	}
+
+	params, err := json.Marshal(&progressParams{
+		ID:    c.request.ID,
+		Seq:   seq,
+		Value: progress,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to marshall rpc progress: %s", err)
 	}
+
+	method := ProgressMethod
+	rawParams := json.RawMessage(params)
+	payload, err := json.Marshal(&serverRequest{
+		Method:  &method,
+		Params:  &rawParams,
+		Version: Version,
+		Time:    makeTimestamp(),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to marshall rpc progress: %s", err)
+	}
+
+	properties := c.properties
+	if c.batch != nil && properties != nil {
+		// The batch's correlation data (if any) isn't this request's id
+		properties = &bus.MessageProperties{ResponseTopic: properties.ResponseTopic}
+	}
+
+	rpc.PublishResponse(client, c.topic, properties, payload)
+	return nil
 }
 
 func makeTimestamp() int64 {
@@ -7,6 +7,7 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
 	log2 "log"
 	"reflect"
@@ -18,9 +19,11 @@ import (
 )
 
 var (
-	// Precompute the reflect.Type of error and *rpc.Message
-	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
-	typeOfRequest = reflect.TypeOf((*Message)(nil))
+	// Precompute the reflect.Type of error, context.Context, *rpc.Message and redis.Conn
+	typeOfError     = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext   = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfRequest   = reflect.TypeOf((*Message)(nil))
+	typeOfRedisConn = reflect.TypeOf((*redis.Conn)(nil)).Elem()
 )
 
 // ----------------------------------------------------------------------------
@@ -29,16 +32,39 @@ var (
 
 type service struct {
 	name     string                    // name of service
+	schema   string                    // URI of the service's schema
 	rcvr     reflect.Value             // receiver of methods for the service
 	rcvrType reflect.Type              // type of the receiver
 	methods  map[string]*serviceMethod // registered methods
+
+	interceptors []ServerInterceptor // called around the methods, after the server's
 }
 
 type serviceMethod struct {
 	method       reflect.Method // receiver method
 	argsType     reflect.Type   // type of the request argument
 	replyType    reflect.Type   // type of the response argument
+	hasContext   bool           // the method takes a context.Context
+	hasMessage   bool           // the method takes a *Message
 	hasRedisConn bool
+	serial       bool // calls must not run concurrently
+
+	queueOnce sync.Once
+	calls     chan func() // a serial method's calls, waiting to be made one at a time
+}
+
+// queue returns where a serial method's calls wait their turn, starting the goroutine that makes them
+// the first time it is asked for
+func (m *serviceMethod) queue(size int) chan<- func() {
+	m.queueOnce.Do(func() {
+		m.calls = make(chan func(), size)
+		go func() {
+			for call := range m.calls {
+				call()
+			}
+		}()
+	})
+	return m.calls
 }
 
 // ----------------------------------------------------------------------------
@@ -55,8 +81,9 @@ type rpcService interface {
 	GetRPCMethods() []string
 }
 
-// register adds a new service using reflection to extract its methods.
-func (m *serviceMap) register(rcvr interface{}, name string, exportableMethods []string) (methods []string, err error) {
+// register adds a new service using reflection to extract its methods. Calls to serialMethods are
+// made one at a time, and all of them through the interceptors.
+func (m *serviceMap) register(rcvr interface{}, name string, schema string, exportableMethods []string, serialMethods []string, interceptors []ServerInterceptor) (methods []string, err error) {
 
 	/*var providedMethods *[]string
 	switch rcvr := rcvr.(type) {
@@ -67,9 +94,12 @@ func (m *serviceMap) register(rcvr interface{}, name string, exportableMethods [
 	// Setup service.
 	s := &service{
 		name:     name,
+		schema:   schema,
 		rcvr:     reflect.ValueOf(rcvr),
 		rcvrType: reflect.TypeOf(rcvr),
 		methods:  make(map[string]*serviceMethod),
+
+		interceptors: interceptors,
 	}
 	if name == "" {
 		s.name = reflect.Indirect(s.rcvr).Type().Name()
@@ -99,15 +129,26 @@ func (m *serviceMap) register(rcvr interface{}, name string, exportableMethods [
 			continue
 		}
 
+		// The receiver may be followed by a context.Context and then a *Message
+		in := 1
+		hasContext := in < mtype.NumIn() && mtype.In(in) == typeOfContext
+		if hasContext {
+			in++
+		}
+		hasMessage := in < mtype.NumIn() && mtype.In(in) == typeOfRequest
+		if hasMessage {
+			in++
+		}
+
 		var hasRedisConn = false
 		nonRedisConn := mtype.NumIn()
-		if (mtype.NumIn() == 2 || mtype.NumIn() == 3) && mtype.In(mtype.NumIn()-1).Implements(reflect.TypeOf((*redis.Conn)(nil)).Elem()) {
+		if (mtype.NumIn() == in+1 || mtype.NumIn() == in+2) && mtype.In(mtype.NumIn()-1).Implements(typeOfRedisConn) {
 			hasRedisConn = true
 			nonRedisConn--
 		}
 
 		// Method must have no or one arguments (plus optional redis connection)
-		if nonRedisConn > 2 {
+		if nonRedisConn > in+1 {
 			//log.Infof("Wrong number: %s", method.Name)
 			continue
 		}
@@ -120,8 +161,8 @@ func (m *serviceMap) register(rcvr interface{}, name string, exportableMethods [
 
 		// The one argument (args) must be a pointer and must be exported, if its there
 		var args reflect.Type
-		if nonRedisConn > 1 {
-			args = mtype.In(1)
+		if nonRedisConn > in {
+			args = mtype.In(in)
 			if !isExportedOrBuiltin(args) {
 				log2.Fatalf("RPC Method %s.%s arguments must be exported", name, method.Name)
 				continue
@@ -153,7 +194,10 @@ func (m *serviceMap) register(rcvr interface{}, name string, exportableMethods [
 
 		s.methods[method.Name] = &serviceMethod{
 			method:       method,
+			hasContext:   hasContext,
+			hasMessage:   hasMessage,
 			hasRedisConn: hasRedisConn,
+			serial:       isValueInList(lowerFirst(method.Name), serialMethods),
 		}
 		if reply != nil {
 			s.methods[method.Name].replyType = reply.Elem()
@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"sync"
+)
+
+// WorkerStats are the counters kept by a pool of RPC workers
+type WorkerStats struct {
+	Workers int    // Requests that can be served at once
+	Queued  int    // Requests waiting for a free worker
+	Active  int    // Requests being served right now
+	Served  uint64 // Requests that have been served
+}
+
+// workerPool serves requests on a fixed number of goroutines. Requests wait in a bounded queue for a
+// free worker, and once that is full, submit blocks. That holds up the bus subscription the requests
+// arrive on, whose own buffer and policy then decide what happens to the rest.
+type workerPool struct {
+	jobs chan func()
+
+	mutex sync.Mutex // protects following
+	stats WorkerStats
+}
+
+func newWorkerPool(workers int, queueSize int) *workerPool {
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	p := &workerPool{
+		jobs:  make(chan func(), queueSize),
+		stats: WorkerStats{Workers: workers},
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+func (p *workerPool) work() {
+	for job := range p.jobs {
+		p.mutex.Lock()
+		p.stats.Queued--
+		p.stats.Active++
+		p.mutex.Unlock()
+
+		job()
+
+		p.mutex.Lock()
+		p.stats.Active--
+		p.stats.Served++
+		p.mutex.Unlock()
+	}
+}
+
+// submit queues a job for the next free worker, waiting for room in the queue if it is full
+func (p *workerPool) submit(job func()) {
+	p.mutex.Lock()
+	p.stats.Queued++
+	p.mutex.Unlock()
+
+	p.jobs <- job
+}
+
+func (p *workerPool) Stats() WorkerStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.stats
+}
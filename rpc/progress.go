@@ -0,0 +1,157 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ninjasphere/go-ninja/bus"
+)
+
+// ProgressWriter is implemented by CodecRequests that can send the caller updates on a request before
+// its response. They go where the response will, and are numbered from 1 so the caller can tell
+// which is the latest.
+type ProgressWriter interface {
+	WriteProgress(c bus.Bus, seq int, progress interface{}) error
+}
+
+// ProgressClientCodec is implemented by client codecs that can decode the updates sent by a ProgressWriter
+type ProgressClientCodec interface {
+	// DecodeProgress returns the id of the call an update is for, and its number. ok is false if msg
+	// isn't an update.
+	DecodeProgress(msg []byte) (id string, seq int, ok bool)
+	DecodeProgressValue(msg []byte, value interface{}) error
+}
+
+// ----------------------------------------------------------------------------
+// Server
+// ----------------------------------------------------------------------------
+
+type progressKey struct{}
+
+// progressReporter sends the updates on one request
+type progressReporter struct {
+	server      *Server
+	serviceSpec *service
+	method      string
+	codecReq    CodecRequest
+	id          string // The request id, empty for notifications
+
+	mutex    sync.Mutex // protects following, and orders the updates
+	seq      int
+	returned bool
+}
+
+// SendProgress sends the caller an update on a long running method, e.g. how far through a firmware
+// update it is. ctx must be the context the method was called with. Updates are checked against the
+// method's "progress" schema, if it has one.
+//
+// Updates are best effort: the caller may miss some, but never gets them out of order or after the
+// method has returned. Nothing is sent for notifications, which have no caller waiting.
+func SendProgress(ctx context.Context, progress interface{}) error {
+	reporter, ok := ctx.Value(progressKey{}).(*progressReporter)
+	if !ok {
+		return fmt.Errorf("Progress can only be sent with the context an RPC method was called with")
+	}
+	return reporter.send(progress)
+}
+
+func (r *progressReporter) send(progress interface{}) error {
+	writer, ok := r.codecReq.(ProgressWriter)
+	if !ok {
+		return NewError(E_NOT_SUPPORTED, "The rpc codec can't send progress")
+	}
+
+	if r.id == "" {
+		return nil
+	}
+
+	if validationEnabled() {
+		if err := validateMethod(r.serviceSpec, r.method, "progress", progress); err != nil {
+			return err
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.returned {
+		return fmt.Errorf("Method %s on %s has already returned, its progress can't be sent", r.method, r.serviceSpec.name)
+	}
+
+	r.seq++
+	return writer.WriteProgress(r.server.client, r.seq, progress)
+}
+
+// finish stops any more updates being sent, once the method has returned
+func (r *progressReporter) finish() {
+	r.mutex.Lock()
+	r.returned = true
+	r.mutex.Unlock()
+}
+
+// ----------------------------------------------------------------------------
+// Client
+// ----------------------------------------------------------------------------
+
+// Progress is an update on a call, sent by the method before its reply
+type Progress struct {
+	Call    *Call
+	Seq     int // Numbered from 1, later updates have higher numbers
+	payload []byte
+	codec   ProgressClientCodec
+}
+
+// Decode decodes the update into value, as a reply would be
+func (p *Progress) Decode(value interface{}) error {
+	return p.codec.DecodeProgressValue(p.payload, value)
+}
+
+// CallContextWithProgress invokes a function synchronously, as CallContext does, and passes the
+// updates sent by the method (see SendProgress) to onProgress as they arrive. onProgress is called
+// from the calling goroutine, one update at a time, and never once CallContextWithProgress has
+// returned. Updates it can't keep up with are dropped.
+//
+// The context's deadline has to allow for the whole call: updates don't extend it.
+func (client *Client) CallContextWithProgress(ctx context.Context, topic string, serviceMethod string, args interface{}, reply interface{}, onProgress func(*Progress)) error {
+	call := &Call{
+		ID:            client.newID(),
+		Topic:         topic,
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Done:          make(chan *Call, 1),
+		Reply:         reply,
+	}
+	if onProgress != nil {
+		call.progress = make(chan *Progress, progressBuffer)
+	}
+
+	return client.wait(ctx, call, onProgress)
+}
+
+// How many updates can wait for the caller's onProgress
+const progressBuffer = 16
+
+// handleProgress passes an update to the call it is for, if it is still waiting for them and hasn't
+// had a later one
+func (client *Client) handleProgress(id string, seq int, payload []byte) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	call := client.pending[id]
+	if call == nil || call.progress == nil {
+		log.Debugf("Ignoring progress on call %s", id)
+		return
+	}
+	if seq <= call.lastProgress {
+		log.Debugf("id:%s - Ignoring stale progress %d", id, seq)
+		return
+	}
+	call.lastProgress = seq
+
+	select {
+	case call.progress <- &Progress{Call: call, Seq: seq, payload: payload, codec: client.codec.(ProgressClientCodec)}:
+	default:
+		log.Debugf("id:%s - Dropping progress %d, the caller isn't keeping up", id, seq)
+	}
+}
@@ -0,0 +1,112 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy says how often, and after which errors, a call is tried again. Every attempt is sent
+// with the same call id, so a server that has already served it (see NewServer) replies with the
+// result of the first attempt instead of calling the method again. That makes it safe to retry calls
+// that aren't idempotent, like toggle. Servers only serve an attempt again if the first failed with
+// E_BUSY or E_OFFLINE.
+type RetryPolicy struct {
+	MaxAttempts int // Including the first. 0 or 1 means the call isn't retried.
+	// AttemptTimeout is how long each attempt waits for its reply. If 0, the time left before the
+	// context's deadline is shared between the attempts left.
+	AttemptTimeout time.Duration
+	Backoff        time.Duration // The wait before the first retry, doubled for each after it. Defaults to 200ms.
+	MaxBackoff     time.Duration // The longest wait between attempts. Defaults to 5s.
+	// RetryableCodes are the error codes worth retrying, e.g. E_BUSY or E_OFFLINE. Attempts that
+	// time out are always retried.
+	RetryableCodes []ErrorCode
+}
+
+// retryable reports whether a failed attempt should be tried again
+func (p *RetryPolicy) retryable(err error) bool {
+	var timeout *TimeoutError
+	if errors.As(err, &timeout) {
+		return true
+	}
+	for _, code := range p.RetryableCodes {
+		if IsCode(err, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait after an attempt (counted from 1). It is somewhere between half
+// and all of the exponential delay, so clients retrying together spread out.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.Backoff
+	if delay <= 0 {
+		delay = time.Millisecond * 200
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = time.Second * 5
+	}
+
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// attemptContext returns the context for an attempt, given how many (including it) are left
+func (p *RetryPolicy) attemptContext(ctx context.Context, attemptsLeft int) (context.Context, context.CancelFunc) {
+	if p.AttemptTimeout > 0 {
+		return context.WithTimeout(ctx, p.AttemptTimeout)
+	}
+	if deadline, ok := ctx.Deadline(); ok && attemptsLeft > 1 {
+		return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(attemptsLeft))
+	}
+	return context.WithCancel(ctx)
+}
+
+// CallContextWithRetry invokes a function synchronously, as CallContext does, trying again as the
+// policy says if an attempt fails. A nil policy makes a single attempt. The error is the last
+// attempt's, even if the context is done before the next.
+func (client *Client) CallContextWithRetry(ctx context.Context, topic string, serviceMethod string, args interface{}, reply interface{}, policy *RetryPolicy) error {
+	if policy == nil {
+		policy = &RetryPolicy{}
+	}
+
+	id := client.newID()
+
+	for attempt := 1; ; attempt++ {
+		call := &Call{
+			ID:            id,
+			Topic:         topic,
+			ServiceMethod: serviceMethod,
+			Args:          args,
+			Done:          make(chan *Call, 1),
+			Reply:         reply,
+		}
+
+		attemptCtx, cancel := policy.attemptContext(ctx, policy.MaxAttempts-attempt+1)
+		err := client.wait(attemptCtx, call, nil)
+		cancel()
+
+		if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || !policy.retryable(err) {
+			return err
+		}
+
+		delay := policy.backoff(attempt)
+		log.Debugf("id:%s - Attempt %d failed, retrying in %s: %s", id, attempt, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
@@ -7,17 +7,24 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/ninjasphere/go-ninja/bus"
+	"github.com/ninjasphere/go-ninja/config"
 	"github.com/ninjasphere/go-ninja/schemas"
 	"github.com/ninjasphere/redigo/redis"
 )
 
-// XXX: This is ugly...
+// XXX: This is ugly... If set, the methods that take a redis.Conn are given one from it, unless an
+// interceptor gave them one already (see RedisInterceptor).
 var RedisPool *redis.Pool
 
 // ----------------------------------------------------------------------------
@@ -27,7 +34,11 @@ var RedisPool *redis.Pool
 // Codec creates a CodecRequest to process each request.
 type Codec interface {
 	NewRequest(topic string, payload []byte) (CodecRequest, error)
+	// NewRequestWithProperties creates a request that was received with MQTT 5 properties. If it has a
+	// response topic, the response is sent there instead of to topic + "/reply".
+	NewRequestWithProperties(topic string, payload []byte, properties *bus.MessageProperties) (CodecRequest, error)
 	SendNotification(c bus.Bus, topic string, payload ...interface{}) error
+	SendNotificationWithOptions(c bus.Bus, topic string, options *bus.PublishOptions, payload ...interface{}) error
 }
 
 // CodecRequest decodes a request and encodes a response using a specific
@@ -43,34 +54,136 @@ type CodecRequest interface {
 	WriteError(c bus.Bus, err error)
 }
 
+// BatchCodec is implemented by codecs that can take several requests in one message
+type BatchCodec interface {
+	// IsBatch reports whether a message holds a batch of requests.
+	IsBatch(payload []byte) bool
+	// NewBatchRequest returns the requests in a batch. Their responses are collected, and sent
+	// together once every one of them has written one.
+	NewBatchRequest(topic string, payload []byte, properties *bus.MessageProperties) ([]CodecRequest, error)
+}
+
+// RequestDescriber is implemented by CodecRequests that can say more about a request, for the methods
+// that take a *Message.
+type RequestDescriber interface {
+	// Reads the request id, or "" if it is a notification.
+	ID() string
+	// Reads when the caller sent the request, or the zero time if it didn't say.
+	Time() time.Time
+}
+
+// ResultEncoder is implemented by CodecRequests that can encode a reply before writing it, so the
+// server can keep the reply as it was sent, to replay to duplicates of the request (see NewServer).
+type ResultEncoder interface {
+	// Encodes a reply as WriteResponse would write it.
+	EncodeResult(response interface{}) ([]byte, error)
+	// Writes the response with a reply encoded by EncodeResult.
+	WriteEncodedResponse(c bus.Bus, result []byte)
+}
+
 // ----------------------------------------------------------------------------
 // Server
 // ----------------------------------------------------------------------------
 
-// NewServer returns a new RPC server.
+// NewServer returns a new RPC server. By default each service's requests are served in its
+// subscription's callback, one at a time, so methods never run concurrently. Set rpc.workers to serve
+// them on a pool of that many workers shared by all its services, with room for rpc.queueSize
+// (default 100) more to wait for one, or give a service workers of its own (see ServiceOptions).
+// Methods served by workers must be safe to call concurrently, or listed in SerialMethods.
+//
+// Requests are remembered for rpc.dedupWindow (default 1m), up to rpc.dedupSize (default 10000) of
+// them, and any sent again in that time (e.g. by a client retrying, see RetryPolicy) are given the
+// first one's response instead of being served again. Only requests with ids of the form
+// "<caller>-<n>", where <caller> is unique to the client that sent it (as Client's ids are), are
+// remembered: others, like plain counters, can be chosen alike by different callers. Responses worth
+// retrying (E_BUSY or E_OFFLINE errors) aren't remembered. Set rpc.dedupWindow to "0s" to serve every
+// request.
 func NewServer(client bus.Bus, codec Codec) *Server {
-	return &Server{
-		client:   client,
-		codec:    codec,
-		services: new(serviceMap),
+	s := &Server{
+		client:    client,
+		codec:     codec,
+		services:  new(serviceMap),
+		queueSize: config.Int(100, "rpc", "queueSize"),
+	}
+	if workers := config.Int(0, "rpc", "workers"); workers > 0 {
+		s.pool = newWorkerPool(workers, s.queueSize)
+	}
+	if window := config.Duration(time.Minute, "rpc", "dedupWindow"); window > 0 {
+		s.dedup = newDedupCache(window, config.Int(10000, "rpc", "dedupSize"))
 	}
+	return s
 }
 
 // Server serves registered RPC services using registered codecs.
 type Server struct {
-	client   bus.Bus
-	codec    Codec
-	services *serviceMap
+	client    bus.Bus
+	codec     Codec
+	services  *serviceMap
+	pool      *workerPool // nil if requests are served inline (the default)
+	queueSize int
+	dedup     *dedupCache // nil if duplicate requests are served again
+
+	interceptorsMutex sync.Mutex // protects following
+	interceptors      []ServerInterceptor
+}
+
+// ServiceOptions control how the requests to a service are served
+type ServiceOptions struct {
+	// Workers gives the service its own pool of workers, so it neither waits for nor holds up the
+	// server's other services, and its methods can run concurrently. 0 shares the server's pool if it
+	// has one (see NewServer), and otherwise serves the service's requests one at a time.
+	Workers int
+	// QueueSize is how many requests can wait for one of the service's own workers. Defaults to rpc.queueSize.
+	QueueSize int
+	// SerialMethods are the methods (named as in the schema, e.g. "setOnOff") that aren't safe to run concurrently. Calls to each of them
+	// wait in a queue of their own (of rpc.queueSize) to be made one at a time, while the workers carry on
+	// with the service's other methods. Calls that find the queue full are refused with E_BUSY, rather than
+	// hold up a worker. If not given, they are taken from the receiver's GetSerialRPCMethods, if it has one.
+	SerialMethods []string
+	// Interceptors are called around the service's methods, after the server's (see Server.Use).
+	Interceptors []ServerInterceptor
+}
+
+// serialService is implemented by receivers with methods that mustn't be called concurrently
+type serialService interface {
+	GetSerialRPCMethods() []string
+}
+
+// Stats returns the counters of the worker pool shared by the server's services. They are all zero if
+// requests are served inline.
+func (s *Server) Stats() WorkerStats {
+	if s.pool == nil {
+		return WorkerStats{}
+	}
+	return s.pool.Stats()
 }
 
 type ExportedService struct {
 	Methods []string
-	topic   string
-	server  *Server
-	schema  string
+	// EventOptions controls how each named event is published (e.g. retaining "state").
+	// Events without an entry are sent at QoS 0 and not retained.
+	EventOptions map[string]*bus.PublishOptions
+	topic        string
+	server       *Server
+	schema       string
+	pool         *workerPool
+}
+
+// Stats returns the counters of the worker pool serving the service, which is the server's unless
+// it was given its own.
+func (s *ExportedService) Stats() WorkerStats {
+	if s.pool == nil {
+		return WorkerStats{}
+	}
+	return s.pool.Stats()
 }
 
 func (s *ExportedService) SendEvent(event string, payload ...interface{}) error {
+	return s.SendEventWithOptions(event, s.EventOptions[event], payload...)
+}
+
+// SendEventWithOptions validates and sends an event, using the given QoS and retain options
+func (s *ExportedService) SendEventWithOptions(event string, options *bus.PublishOptions, payload ...interface{}) error {
 
 	schema := s.schema + "#/events/" + event + "/value"
 
@@ -108,7 +221,7 @@ func (s *ExportedService) SendEvent(event string, payload ...interface{}) error
 		}
 	}
 
-	return s.server.SendNotification(s.topic+"/event/"+event, payload...)
+	return s.server.SendNotificationWithOptions(s.topic+"/event/"+event, options, payload...)
 }
 
 // RegisterService adds a new service to the server.
@@ -121,19 +234,42 @@ func (s *ExportedService) SendEvent(event string, payload ...interface{}) error
 //    - The receiver is exported (begins with an upper case letter) or local
 //      (defined in the package registering the service).
 //    - The method name is exported.
-//    - The method's first argument is *mqtt.Message
-//    - If there is a second argument (the RPC params value) it must be exported and a pointer
+//    - The method may take a context.Context and then a *rpc.Message, which describe the request
+//      (its context can also send the caller progress, see SendProgress)
+//    - If there is another argument (the RPC params value) it must be exported
+//    - The method may take a redis.Conn last, see RedisInterceptor
 //    - If there is a return value, it must be first, exported and a pointer
 //    - The method's last return value is an error
 //
 // All other methods are ignored.
 func (s *Server) RegisterService(receiver interface{}, topic string, schema string) (service *ExportedService, err error) {
+	return s.RegisterServiceWithOptions(receiver, topic, schema, nil)
+}
 
-	_, err = s.client.Subscribe(topic, func(topic string, payload []byte) {
-		s.serveRequest(topic, payload)
-	})
+// RegisterServiceWithOptions adds a new service to the server, served as the options say
+func (s *Server) RegisterServiceWithOptions(receiver interface{}, topic string, schema string, options *ServiceOptions) (service *ExportedService, err error) {
 
-	if err != nil {
+	if options == nil {
+		options = &ServiceOptions{}
+	}
+
+	serialMethods := options.SerialMethods
+	if serialMethods == nil {
+		if receiver, ok := receiver.(serialService); ok {
+			serialMethods = receiver.GetSerialRPCMethods()
+		}
+	}
+
+	pool := s.pool
+	if options.Workers > 0 {
+		queueSize := options.QueueSize
+		if queueSize == 0 {
+			queueSize = s.queueSize
+		}
+		pool = newWorkerPool(options.Workers, queueSize)
+	}
+
+	if err := s.listen(topic, pool); err != nil {
 		return nil, err
 	}
 
@@ -142,7 +278,7 @@ func (s *Server) RegisterService(receiver interface{}, topic string, schema stri
 		return nil, err
 	}
 
-	exportedMethods, err := s.services.register(receiver, topic, methods)
+	exportedMethods, err := s.services.register(receiver, topic, schema, methods, serialMethods, options.Interceptors)
 
 	var exportedMethodsLower []string
 
@@ -150,7 +286,50 @@ func (s *Server) RegisterService(receiver interface{}, topic string, schema stri
 		exportedMethodsLower = append(exportedMethodsLower, lowerFirst(m))
 	}
 
-	return &ExportedService{Methods: exportedMethodsLower, topic: topic, server: s, schema: schema}, err
+	return &ExportedService{Methods: exportedMethodsLower, topic: topic, server: s, schema: schema, pool: pool}, err
+}
+
+// PublishResponse is for codecs to send the response to a request. It goes only to the caller if it
+// gave a response topic, otherwise to everyone listening to topic + "/reply".
+func PublishResponse(client bus.Bus, topic string, properties *bus.MessageProperties, payload []byte) {
+	if properties != nil && properties.ResponseTopic != "" {
+		if propertiesBus, ok := client.(bus.PropertiesBus); ok {
+			log.Debugf("< Outgoing to %s : %s", properties.ResponseTopic, payload)
+			propertiesBus.PublishWithProperties(properties.ResponseTopic, payload, nil, &bus.MessageProperties{
+				CorrelationData: properties.CorrelationData,
+			})
+			return
+		}
+	}
+
+	log.Debugf("< Outgoing to %s : %s", topic+"/reply", payload)
+
+	client.Publish(topic+"/reply", payload)
+}
+
+// listen subscribes to requests to a service, and hands them to the pool to be served. The service's
+// topic may contain wildcards, in which case requests arrive on (and are replied to from) the topics
+// it matches.
+func (s *Server) listen(service string, pool *workerPool) error {
+	dispatch := func(topic string, payload []byte, properties *bus.MessageProperties) {
+		if pool == nil {
+			s.serveRequest(service, topic, payload, properties, false)
+			return
+		}
+		pool.submit(func() {
+			s.serveRequest(service, topic, payload, properties, true)
+		})
+	}
+
+	if propertiesBus, ok := s.client.(bus.PropertiesBus); ok {
+		_, err := propertiesBus.SubscribeWithProperties(service, nil, dispatch)
+		return err
+	}
+
+	_, err := s.client.Subscribe(service, func(topic string, payload []byte) {
+		dispatch(topic, payload, nil)
+	})
+	return err
 }
 
 func lowerFirst(s string) string {
@@ -166,6 +345,11 @@ func (s *Server) SendNotification(topic string, params ...interface{}) error {
 	return s.codec.SendNotification(s.client, topic, params...)
 }
 
+// SendNotificationWithOptions sends a one-way notification using the given QoS and retain options.
+func (s *Server) SendNotificationWithOptions(topic string, options *bus.PublishOptions, params ...interface{}) error {
+	return s.codec.SendNotificationWithOptions(s.client, topic, options, params...)
+}
+
 // HasMethod returns true if the given method is registered on a topic
 func (s *Server) HasMethod(topic string, method string) bool {
 	if _, _, err := s.services.get(topic, method); err == nil {
@@ -174,24 +358,75 @@ func (s *Server) HasMethod(topic string, method string) bool {
 	return false
 }
 
+// Message describes the request a method is serving. A method can ask for it by taking a *Message
+// before its params (after its context.Context, if it takes one of those too). A service registered
+// on a topic with wildcards can use it to find out which topic it was called on.
 type Message struct {
-	Payload []byte
-	Topic   string
+	Payload    []byte // The whole message, which for a batch holds the other requests too
+	Topic      string
+	ID         string                 // The request id, empty for notifications
+	Time       time.Time              // When the caller sent the request, zero if it didn't say
+	Properties *bus.MessageProperties // The request's MQTT 5 properties, if it had any
 }
 
-// ServeRequest handles an incoming Json-RPC MQTT message
-func (s *Server) serveRequest(topic string, payload []byte) {
+type messageKey struct{}
+
+// MessageFromContext returns the request being served, given the context passed to its method
+func MessageFromContext(ctx context.Context) (*Message, bool) {
+	message, ok := ctx.Value(messageKey{}).(*Message)
+	return message, ok
+}
+
+// ServeRequest handles an incoming Json-RPC MQTT message to a service. The requests in a batch are
+// served one after another, though on a worker, calls to serial methods wait their turn in the
+// method's queue, so can be made after the requests that follow them.
+func (s *Server) serveRequest(service string, topic string, payload []byte, properties *bus.MessageProperties, pooled bool) {
 
 	log.Debugf("Serving request to %s", topic)
 
+	if batchCodec, ok := s.codec.(BatchCodec); ok && batchCodec.IsBatch(payload) {
+		requests, err := batchCodec.NewBatchRequest(topic, payload, properties)
+		if err != nil {
+			// There are no ids we could reply to, so the error is sent back on its own
+			log.Infof("Bad batch request to %s error:%s", topic, err)
+			if codecReq, _ := s.codec.NewRequestWithProperties(topic, payload, properties); codecReq != nil {
+				codecReq.WriteError(s.client, err)
+			}
+			return
+		}
+		for _, codecReq := range requests {
+			s.serveCodecRequest(service, topic, payload, properties, pooled, codecReq)
+		}
+		return
+	}
+
 	// Create a new codec request.
-	codecReq, err := s.codec.NewRequest(topic, payload)
+	codecReq, err := s.codec.NewRequestWithProperties(topic, payload, properties)
 
 	if err != nil {
 		codecReq.WriteError(s.client, err)
 		return
 	}
 
+	s.serveCodecRequest(service, topic, payload, properties, pooled, codecReq)
+}
+
+// serveCodecRequest calls the method a request is for, and writes its response. pooled is true if it
+// is being served by a worker.
+func (s *Server) serveCodecRequest(service string, topic string, payload []byte, properties *bus.MessageProperties, pooled bool, codecReq CodecRequest) {
+
+	if describer, ok := codecReq.(RequestDescriber); ok && s.dedup != nil {
+		if key, ok := dedupKey(topic, properties, describer.ID()); ok {
+			entry, duplicate := s.dedup.start(key)
+			if duplicate {
+				log.Debugf("id:%s - Replaying the response to a duplicate request to %s", describer.ID(), topic)
+				s.dedup.replay(s.client, entry, codecReq)
+				return
+			}
+			codecReq = &dedupRequest{CodecRequest: codecReq, describer: describer, cache: s.dedup, entry: entry}
+		}
+	}
+
 	// Get service method to be called.
 	method, errMethod := codecReq.Method()
 	if errMethod != nil {
@@ -199,11 +434,32 @@ func (s *Server) serveRequest(topic string, payload []byte) {
 		return
 	}
 
-	serviceSpec, methodSpec, errGet := s.services.get(topic, method)
+	serviceSpec, methodSpec, errGet := s.services.get(service, method)
 	if errGet != nil {
 		codecReq.WriteError(s.client, errGet)
 		return
 	}
+	// The params are validated as the caller sent them, before they are decoded into args: params of the
+	// wrong type would fail to decode with a less useful error, and decoding loses anything missing or
+	// extra. Methods that take no params are held to their schema too, and params that can't even be
+	// read fail validation.
+	if validationEnabled() {
+		var params interface{}
+		if errRead := codecReq.ReadRequest(&params); errRead != nil {
+			codecReq.WriteError(s.client, &ValidationError{
+				Service:  serviceSpec.name,
+				Method:   method,
+				Section:  "params",
+				Messages: []string{errRead.Error()},
+			})
+			return
+		}
+		if errValidate := validateMethod(serviceSpec, method, "params", params); errValidate != nil {
+			codecReq.WriteError(s.client, errValidate)
+			return
+		}
+	}
+
 	// Decode the args.
 	var args reflect.Value
 	if methodSpec.argsType != nil {
@@ -217,66 +473,192 @@ func (s *Server) serveRequest(topic string, payload []byte) {
 			codecReq.WriteError(s.client, errRead)
 			return
 		}
+	}
+	// A serial method's calls wait their turn in its queue, instead of holding up a worker that could
+	// be serving the service's other methods. Served inline, calls are already made one at a time.
+	if methodSpec.serial && pooled {
+		select {
+		case methodSpec.queue(s.queueSize) <- func() {
+			s.call(service, topic, payload, properties, codecReq, serviceSpec, methodSpec, method, args)
+		}:
+		default:
+			// Waiting for room would hold up the worker instead
+			log.Warningf("Refusing a call to %s on %s, as %d are already waiting", method, service, s.queueSize)
+			codecReq.WriteError(s.client, NewError(E_BUSY, "Too many calls to %s are waiting", method))
+		}
+		return
+	}
 
+	s.call(service, topic, payload, properties, codecReq, serviceSpec, methodSpec, method, args)
+}
+
+// call calls the service method a request is for, through the interceptors, with its decoded args,
+// and writes its response
+func (s *Server) call(service string, topic string, payload []byte, properties *bus.MessageProperties, codecReq CodecRequest, serviceSpec *service, methodSpec *serviceMethod, method string, args reflect.Value) {
+
+	message := &Message{
+		Payload:    payload,
+		Topic:      topic,
+		Properties: properties,
+	}
+	if describer, ok := codecReq.(RequestDescriber); ok {
+		message.ID = describer.ID()
+		message.Time = describer.Time()
 	}
-	// Call the service method.
 
-	params := []reflect.Value{
-		serviceSpec.rcvr,
+	reporter := &progressReporter{
+		server:      s,
+		serviceSpec: serviceSpec,
+		method:      method,
+		codecReq:    codecReq,
+		id:          message.ID,
 	}
+	defer reporter.finish()
 
-	/*
-		TODO: Allow the method to request an rpc.Message
-		reflect.ValueOf(&Message{
-			Payload: message.Payload(),
-			Topic:   topic,
-		}),*/
+	ctx := context.WithValue(context.Background(), messageKey{}, message)
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, progressKey{}, reporter))
+	defer cancel()
 
+	var params interface{}
 	if methodSpec.argsType != nil {
 		if methodSpec.argsType.Kind() == reflect.Ptr {
-			params = append(params, args)
+			params = args.Interface()
 		} else {
-			params = append(params, args.Elem())
+			params = args.Elem().Interface()
 		}
 	}
 
-	if methodSpec.hasRedisConn {
-		if RedisPool == nil {
-			panic("If RPC methods ask for a redis connection, you must set the pool at rpc.RedisPool")
+	info := &ServerInfo{
+		Service: service,
+		Method:  method,
+		Message: message,
+		method:  methodSpec,
+	}
+
+	handler := chainServer(s.serviceInterceptors(serviceSpec), info, func(ctx context.Context, params interface{}) (interface{}, error) {
+		return s.invoke(serviceSpec, methodSpec, ctx, message, params)
+	})
+
+	reply, errResult := s.callMethod(service, method, handler, ctx, params)
+
+	if errResult == nil && methodSpec.replyType != nil && validationEnabled() {
+		errResult = validateMethod(serviceSpec, method, "returns", reply)
+	}
+
+	// Encode the response.
+	if errResult == nil {
+		codecReq.WriteResponse(s.client, reply)
+	} else {
+		codecReq.WriteError(s.client, errResult)
+	}
+}
+
+// invoke calls a service method with the params it takes, and returns its reply (nil if it has none)
+func (s *Server) invoke(serviceSpec *service, methodSpec *serviceMethod, ctx context.Context, message *Message, params interface{}) (interface{}, error) {
+
+	in := []reflect.Value{
+		serviceSpec.rcvr,
+	}
+
+	if methodSpec.hasContext {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	if methodSpec.hasMessage {
+		in = append(in, reflect.ValueOf(message))
+	}
+
+	if methodSpec.argsType != nil {
+		if params == nil {
+			in = append(in, reflect.Zero(methodSpec.argsType))
+		} else {
+			in = append(in, reflect.ValueOf(params))
 		}
+	}
 
-		conn := RedisPool.Get()
-		defer conn.Close()
-		params = append(params, reflect.ValueOf(conn))
+	if methodSpec.hasRedisConn {
+		conn, ok := ctx.Value(redisConnKey{}).(redis.Conn)
+		if !ok {
+			panic("If RPC methods ask for a redis connection, you must set the pool at rpc.RedisPool, or use a RedisInterceptor")
+		}
+		in = append(in, reflect.ValueOf(conn))
 	}
 
-	/*var reply reflect.Value
-	if methodSpec.replyType != nil {
-		reply = reflect.New(methodSpec.replyType)
-		params = append(params, reply)
-	}*/
+	retVals := methodSpec.method.Func.Call(in)
 
-	retVals := methodSpec.method.Func.Call(params)
 	// Cast the last result to error if needed.
-	var errResult error
-	errInter := retVals[len(retVals)-1].Interface()
-	if errInter != nil {
-		errResult = errInter.(error)
+	var err error
+	if errInter := retVals[len(retVals)-1].Interface(); errInter != nil {
+		err = errInter.(error)
 	}
 
-	var reply reflect.Value
-	if methodSpec.replyType != nil {
-		reply = retVals[0]
+	if methodSpec.replyType == nil {
+		return nil, err
 	}
+	return retVals[0].Interface(), err
+}
 
-	// Encode the response.
-	if errResult == nil {
-		if methodSpec.replyType != nil {
-			codecReq.WriteResponse(s.client, reply.Interface())
-		} else {
-			codecReq.WriteResponse(s.client, nil)
+// These can be replaced in tests, which don't have the schemas
+var validationEnabled = schemas.ValidationEnabled
+var validate = schemas.Validate
+
+// validateMethod validates a method's params or reply (section "params" or "returns") against the
+// service's schema. It returns a ValidationError if they don't match it. Methods without that section
+// in their schema aren't validated.
+func validateMethod(serviceSpec *service, method string, section string, value interface{}) error {
+	schema := serviceSpec.schema + "#/methods/" + lowerFirst(method) + "/" + section
+
+	message, err := validate(schema, value)
+
+	if err != nil {
+		log.Debugf("Not validating %s of %s on %s: %s", section, method, serviceSpec.name, err)
+		return nil
+	}
+
+	if message != nil {
+		log.Warningf("%s of method %s on %s failed validation (schema: %s) message: %s", section, method, serviceSpec.name, schema, *message)
+		return &ValidationError{
+			Service:  serviceSpec.name,
+			Method:   method,
+			Section:  section,
+			Messages: strings.Split(strings.TrimSpace(*message), "\n"),
 		}
-	} else {
-		codecReq.WriteError(s.client, errResult)
 	}
+
+	return nil
+}
+
+// PanicError is the error returned to the caller of a method that panicked
+type PanicError struct {
+	Service string
+	Method  string
+	Value   interface{} // What the method panicked with
+	Stack   []byte      // Where it panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Method %s on %s panicked: %v", e.Method, e.Service, e.Value)
+}
+
+// callMethod calls a service method (through its interceptors). If it panics, the panic is logged (and
+// reported to bugsnag) and returned as a PanicError, so the caller gets a reply instead of the driver
+// dying. Set rpc.crashOnPanic to let the panic through, which is handier during development.
+func (s *Server) callMethod(service string, method string, handler MethodHandler, ctx context.Context, params interface{}) (reply interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			errPanic := &PanicError{
+				Service: service,
+				Method:  method,
+				Value:   r,
+				Stack:   debug.Stack(),
+			}
+			log.HandleError(errPanic, fmt.Sprintf("RPC method panicked\n%s", errPanic.Stack))
+
+			if config.Bool(false, "rpc", "crashOnPanic") {
+				panic(r)
+			}
+			err = errPanic
+		}
+	}()
+
+	return handler(ctx, params)
 }
@@ -0,0 +1,1022 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/bus"
+	"github.com/ninjasphere/redigo/redis"
+)
+
+// testServerCodec serves requests of the form {"id":...,"method":...,"params":...} and replies as testCodec expects
+type testServerCodec struct{}
+
+type testRequest struct {
+	ID     string          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type testCodecRequest struct {
+	topic   string
+	request *testRequest
+}
+
+func (c *testServerCodec) NewRequest(topic string, payload []byte) (CodecRequest, error) {
+	return c.NewRequestWithProperties(topic, payload, nil)
+}
+
+func (c *testServerCodec) NewRequestWithProperties(topic string, payload []byte, properties *bus.MessageProperties) (CodecRequest, error) {
+	req := &testCodecRequest{topic: topic, request: &testRequest{}}
+	return req, json.Unmarshal(payload, req.request)
+}
+
+func (c *testServerCodec) SendNotification(b bus.Bus, topic string, payload ...interface{}) error {
+	return nil
+}
+
+func (c *testServerCodec) SendNotificationWithOptions(b bus.Bus, topic string, options *bus.PublishOptions, payload ...interface{}) error {
+	return nil
+}
+
+// IsBatch makes testServerCodec a BatchCodec. The requests in a batch are replied to one by one.
+func (c *testServerCodec) IsBatch(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == '['
+}
+
+func (c *testServerCodec) NewBatchRequest(topic string, payload []byte, properties *bus.MessageProperties) ([]CodecRequest, error) {
+	var batch []*testRequest
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		return nil, err
+	}
+
+	var requests []CodecRequest
+	for _, request := range batch {
+		requests = append(requests, &testCodecRequest{topic: topic, request: request})
+	}
+	return requests, nil
+}
+
+func (r *testCodecRequest) Method() (string, error) {
+	return r.request.Method, nil
+}
+
+func (r *testCodecRequest) ID() string {
+	return r.request.ID
+}
+
+func (r *testCodecRequest) Time() time.Time {
+	return time.Time{}
+}
+
+func (r *testCodecRequest) ReadRequest(args interface{}) error {
+	return json.Unmarshal(r.request.Params, args)
+}
+
+func (r *testCodecRequest) WriteResponse(b bus.Bus, response interface{}) {
+	payload, _ := json.Marshal(&testMessage{ID: r.request.ID, Result: response})
+	b.Publish(r.topic+"/reply", payload)
+}
+
+func (r *testCodecRequest) EncodeResult(response interface{}) ([]byte, error) {
+	return json.Marshal(response)
+}
+
+func (r *testCodecRequest) WriteEncodedResponse(b bus.Bus, result []byte) {
+	r.WriteResponse(b, json.RawMessage(result))
+}
+
+func (r *testCodecRequest) WriteError(b bus.Bus, err error) {
+	var code ErrorCode
+	if coded := CodedError(nil); errors.As(err, &coded) {
+		code = coded.ErrorCode()
+	}
+	payload, _ := json.Marshal(&testMessage{ID: r.request.ID, Result: err.Error(), Code: code})
+	b.Publish(r.topic+"/reply", payload)
+}
+
+// testProgress is an update on a request, before its testMessage reply
+type testProgress struct {
+	ID       string      `json:"id"`
+	Seq      int         `json:"seq"`
+	Progress interface{} `json:"progress"`
+}
+
+func (r *testCodecRequest) WriteProgress(b bus.Bus, seq int, progress interface{}) error {
+	payload, _ := json.Marshal(&testProgress{ID: r.request.ID, Seq: seq, Progress: progress})
+	b.Publish(r.topic+"/reply", payload)
+	return nil
+}
+
+// testClientCodec sends requests that testServerCodec understands
+type testClientCodec struct {
+	testCodec
+}
+
+func (c *testClientCodec) EncodeClientRequest(call *Call) ([]byte, error) {
+	params, _ := json.Marshal(call.Args)
+	return json.Marshal(&testRequest{ID: call.ID, Method: call.ServiceMethod, Params: params})
+}
+
+func (c *testClientCodec) EncodeClientBatch(calls []*Call) ([]byte, error) {
+	var batch []json.RawMessage
+	for _, call := range calls {
+		request, _ := c.EncodeClientRequest(call)
+		batch = append(batch, request)
+	}
+	return json.Marshal(batch)
+}
+
+// codedClientCodec returns coded errors from testServerCodec as errors, rather than as the result
+type codedClientCodec struct {
+	testClientCodec
+}
+
+func (c *codedClientCodec) DecodeIdAndError(msg []byte) (string, error) {
+	res := &testMessage{}
+	if err := json.Unmarshal(msg, res); err != nil {
+		return "", err
+	}
+	if res.Code != 0 {
+		return res.ID, &Error{Code: res.Code, Message: fmt.Sprint(res.Result)}
+	}
+	return res.ID, nil
+}
+
+func (c *testClientCodec) DecodeProgress(msg []byte) (string, int, bool) {
+	progress := &testProgress{}
+	if err := json.Unmarshal(msg, progress); err != nil || progress.Seq == 0 {
+		return "", 0, false
+	}
+	return progress.ID, progress.Seq, true
+}
+
+func (c *testClientCodec) DecodeProgressValue(msg []byte, value interface{}) error {
+	return json.Unmarshal(msg, &testProgress{Progress: value})
+}
+
+func (c *testClientCodec) SplitBatchResponse(msg []byte) ([][]byte, bool) {
+	return nil, false
+}
+
+// blockingService has a method that waits to be released, and one that keeps track of how many calls
+// to it are running at once
+type blockingService struct {
+	started chan bool
+	release chan bool
+
+	mutex      sync.Mutex
+	running    int
+	maxRunning int
+
+	ctx     context.Context // The last context Update was called with
+	toggles int
+	busy    int
+	shared  []string
+}
+
+func (s *blockingService) Slow() (*string, error) {
+	s.started <- true
+	<-s.release
+	reply := "slow"
+	return &reply, nil
+}
+
+func (s *blockingService) Fast() (*string, error) {
+	reply := "fast"
+	return &reply, nil
+}
+
+func (s *blockingService) Count() (*int, error) {
+	s.mutex.Lock()
+	s.running++
+	if s.running > s.maxRunning {
+		s.maxRunning = s.running
+	}
+	s.mutex.Unlock()
+
+	time.Sleep(time.Millisecond * 10)
+
+	s.mutex.Lock()
+	s.running--
+	s.mutex.Unlock()
+	return &s.maxRunning, nil
+}
+
+// Where says which topic it was called on, and checks it was given the same request in its context
+func (s *blockingService) Where(ctx context.Context, message *Message, greeting string) (*string, error) {
+	if fromContext, ok := MessageFromContext(ctx); !ok || fromContext != message {
+		return nil, fmt.Errorf("The context didn't carry the request")
+	}
+	if message.ID == "" {
+		return nil, fmt.Errorf("The request had no id")
+	}
+	reply := greeting + " from " + message.Topic
+	return &reply, nil
+}
+
+// Update sends progress on each of its steps. It waits to be released after the first, and keeps its
+// context so it can be used once the call has returned.
+func (s *blockingService) Update(ctx context.Context, steps int) (*string, error) {
+	s.ctx = ctx
+	for step := 1; step <= steps; step++ {
+		if err := SendProgress(ctx, step*10); err != nil {
+			return nil, err
+		}
+		if step == 1 {
+			<-s.release
+		}
+	}
+	reply := "updated"
+	return &reply, nil
+}
+
+// Toggle counts how often it has been called
+func (s *blockingService) Toggle() (*int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.toggles++
+	toggles := s.toggles
+	return &toggles, nil
+}
+
+// Busy fails with ErrBusy the first time it is called, and then says how often it has been
+func (s *blockingService) Busy() (*int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.busy++
+	if s.busy == 1 {
+		return nil, ErrBusy
+	}
+	busy := s.busy
+	return &busy, nil
+}
+
+// Shared replies with a slice it keeps, and may change later
+func (s *blockingService) Shared() (*[]string, error) {
+	return &s.shared, nil
+}
+
+func (s *blockingService) Panic() error {
+	var nothing map[string]bool
+	nothing["boom"] = true
+	return nil
+}
+
+// newTestServer serves the service on topic, without needing its schema
+func newTestServer(t *testing.T, service interface{}, topic string, serialMethods []string) (*Server, *Client, func()) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	return newTestServerOn(t, memory, &plainBus{memory}, service, topic, serialMethods)
+}
+
+// newTestServerOn serves the service on topic through serverBus, which must be connected to memory.
+// Its requests are served by a pool of workers, as if rpc.workers were set.
+func newTestServerOn(t *testing.T, memory *bus.MemoryBus, serverBus bus.Bus, service interface{}, topic string, serialMethods []string) (*Server, *Client, func()) {
+	server := NewServer(serverBus, &testServerCodec{})
+	server.pool = newWorkerPool(10, server.queueSize)
+	if _, err := server.services.register(service, topic, "test-schema", []string{"slow", "fast", "count", "where", "update", "toggle", "busy", "shared", "panic"}, serialMethods, nil); err != nil {
+		t.Fatalf("Failed to register service: %s", err)
+	}
+	if err := server.listen(topic, server.pool); err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+
+	return server, NewClient(&plainBus{memory}, &testClientCodec{}), memory.Destroy
+}
+
+func TestSlowMethodDoesNotBlockOthers(t *testing.T) {
+	service := &blockingService{started: make(chan bool, 1), release: make(chan bool)}
+	_, client, cleanup := newTestServer(t, service, "service", nil)
+	defer cleanup()
+
+	slow := make(chan error, 1)
+	go func() {
+		var reply string
+		slow <- client.CallWithTimeout("service", "Slow", nil, &reply, time.Second*5)
+	}()
+	<-service.started
+
+	var reply string
+	if err := client.CallWithTimeout("service", "Fast", nil, &reply, time.Second); err != nil {
+		t.Fatalf("Fast call was held up by the slow one: %s", err)
+	}
+	if reply != "fast" {
+		t.Errorf("Unexpected reply: %s", reply)
+	}
+
+	close(service.release)
+	if err := <-slow; err != nil {
+		t.Errorf("Slow call failed: %s", err)
+	}
+}
+
+func TestSerialMethods(t *testing.T) {
+	for _, serial := range []bool{false, true} {
+		service := &blockingService{}
+
+		var serialMethods []string
+		if serial {
+			serialMethods = []string{"count"}
+		}
+
+		t.Run(map[bool]string{false: "concurrent", true: "serial"}[serial], func(t *testing.T) {
+			_, client, cleanup := newTestServer(t, service, "service", serialMethods)
+			defer cleanup()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					var reply int
+					if err := client.CallWithTimeout("service", "Count", nil, &reply, time.Second*5); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if serial && service.maxRunning != 1 {
+				t.Errorf("Expected calls to a serial method to run one at a time, %d ran at once", service.maxRunning)
+			}
+			if !serial && service.maxRunning < 2 {
+				t.Errorf("Expected calls to run concurrently")
+			}
+		})
+	}
+}
+
+func TestServedOneAtATimeByDefault(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	defer memory.Destroy()
+
+	server := NewServer(&plainBus{memory}, &testServerCodec{})
+	if server.pool != nil {
+		t.Fatalf("Expected no workers unless rpc.workers is set")
+	}
+
+	service := &blockingService{}
+	if _, err := server.services.register(service, "service", "test-schema", []string{"count"}, nil, nil); err != nil {
+		t.Fatalf("Failed to register service: %s", err)
+	}
+	if err := server.listen("service", server.pool); err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	client := NewClient(&plainBus{memory}, &testClientCodec{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			if err := client.CallWithTimeout("service", "Count", nil, &reply, time.Second*5); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if service.maxRunning != 1 {
+		t.Errorf("Expected calls to run one at a time, %d ran at once", service.maxRunning)
+	}
+}
+
+func TestSerialCallsDoNotHoldWorkers(t *testing.T) {
+	service := &blockingService{started: make(chan bool, 20), release: make(chan bool)}
+	server, client, cleanup := newTestServer(t, service, "service", []string{"slow"})
+	defer cleanup()
+
+	// More calls to the serial method than there are workers
+	slow := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			var reply string
+			slow <- client.CallWithTimeout("service", "Slow", nil, &reply, time.Second*5)
+		}()
+	}
+	<-service.started
+
+	var reply string
+	if err := client.CallWithTimeout("service", "Fast", nil, &reply, time.Second); err != nil {
+		t.Fatalf("Fast call was held up by the queued serial calls: %s, %+v", err, server.Stats())
+	}
+
+	close(service.release)
+	for i := 0; i < 20; i++ {
+		if err := <-slow; err != nil {
+			t.Errorf("Slow call failed: %s", err)
+		}
+	}
+}
+
+func TestFullSerialQueueIsBusy(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	service := &blockingService{started: make(chan bool, 3), release: make(chan bool)}
+	server, _, cleanup := newTestServerOn(t, memory, &plainBus{memory}, service, "service", []string{"slow"})
+	defer cleanup()
+	server.queueSize = 2
+	client := NewClient(&plainBus{memory}, &codedClientCodec{})
+
+	// One call running, and the queue full behind it
+	slow := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			var reply string
+			slow <- client.CallWithTimeout("service", "Slow", nil, &reply, time.Second*5)
+		}()
+	}
+	<-service.started
+	_, methodSpec, _ := server.services.get("service", "Slow")
+	for deadline := time.Now().Add(time.Second); len(methodSpec.calls) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the queue to fill")
+		}
+	}
+
+	var reply string
+	if err := client.CallWithTimeout("service", "Slow", nil, &reply, time.Second); !IsCode(err, E_BUSY) {
+		t.Errorf("Expected a call finding the queue full to be busy, got %v", err)
+	}
+
+	close(service.release)
+	for i := 0; i < 3; i++ {
+		if err := <-slow; err != nil {
+			t.Errorf("Queued call failed: %s", err)
+		}
+	}
+}
+
+func TestWorkerPoolStats(t *testing.T) {
+	pool := newWorkerPool(1, 10)
+	release := make(chan bool)
+
+	for i := 0; i < 4; i++ {
+		pool.submit(func() {
+			<-release
+		})
+	}
+
+	// Wait for the worker to pick up the first job
+	for i := 0; i < 100 && pool.Stats().Active == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if stats := pool.Stats(); stats != (WorkerStats{Workers: 1, Queued: 3, Active: 1}) {
+		t.Errorf("Unexpected stats while blocked: %+v", stats)
+	}
+
+	close(release)
+
+	for i := 0; i < 100 && pool.Stats().Served < 4; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if stats := pool.Stats(); stats != (WorkerStats{Workers: 1, Served: 4}) {
+		t.Errorf("Unexpected stats once drained: %+v", stats)
+	}
+}
+
+func TestMethodsReceiveMessage(t *testing.T) {
+	_, client, cleanup := newTestServer(t, &blockingService{}, "$device/+/channel/+", nil)
+	defer cleanup()
+
+	for _, topic := range []string{"$device/1/channel/light", "$device/2/channel/switch"} {
+		var reply string
+		if err := client.CallWithTimeout(topic, "Where", "hello", &reply, time.Second); err != nil {
+			t.Fatalf("Call to %s failed: %s", topic, err)
+		}
+		if reply != "hello from "+topic {
+			t.Errorf("Unexpected reply: %s", reply)
+		}
+	}
+}
+
+func TestMethodPanicIsReturned(t *testing.T) {
+	_, client, cleanup := newTestServer(t, &blockingService{}, "service", []string{"panic"})
+	defer cleanup()
+
+	// testServerCodec returns errors as the result
+	var reply string
+	if err := client.CallWithTimeout("service", "Panic", nil, &reply, time.Second); err != nil {
+		t.Fatalf("Expected a reply to the call that panicked, got %s", err)
+	}
+	if reply != "Method Panic on service panicked: assignment to entry in nil map" {
+		t.Errorf("Unexpected reply: %s", reply)
+	}
+
+	// The serial method's lock must have been released, and the server must still be serving
+	if err := client.CallWithTimeout("service", "Panic", nil, &reply, time.Second); err != nil {
+		t.Errorf("Second call failed: %s", err)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	defer func(enabled func() bool, original func(string, interface{}) (*string, error)) {
+		validationEnabled, validate = enabled, original
+	}(validationEnabled, validate)
+
+	var validated []string
+	var mutex sync.Mutex
+
+	validationEnabled = func() bool { return true }
+	validate = func(schema string, value interface{}) (*string, error) {
+		mutex.Lock()
+		validated = append(validated, schema)
+		mutex.Unlock()
+
+		_, isString := value.(string)
+		wrongType := strings.HasSuffix(schema, "where/params") && !isString
+		if reply, ok := value.(*string); value == "bad" || wrongType || ok && strings.HasSuffix(*reply, "nowhere") {
+			message := "Not acceptable\n"
+			return &message, nil
+		}
+		return nil, nil
+	}
+
+	_, client, cleanup := newTestServer(t, &blockingService{}, "$device/+/channel/+", nil)
+	defer cleanup()
+
+	var reply string
+	if err := client.CallWithTimeout("$device/1/channel/light", "Where", "good", &reply, time.Second); err != nil || reply != "good from $device/1/channel/light" {
+		t.Errorf("Valid call failed: %s %s", reply, err)
+	}
+	if fmt.Sprint(validated) != "[test-schema#/methods/where/params test-schema#/methods/where/returns]" {
+		t.Errorf("Unexpected schemas validated against: %v", validated)
+	}
+
+	// testServerCodec returns errors as the result
+	client.CallWithTimeout("$device/1/channel/light", "Where", "bad", &reply, time.Second)
+	if reply != "Method Where on $device/+/channel/+ failed validation of its params: Not acceptable" {
+		t.Errorf("Unexpected reply to bad params: %s", reply)
+	}
+
+	client.CallWithTimeout("$device/1/channel/nowhere", "Where", "good", &reply, time.Second)
+	if reply != "Method Where on $device/+/channel/+ failed validation of its returns: Not acceptable" {
+		t.Errorf("Unexpected reply when the reply is bad: %s", reply)
+	}
+
+	// Params that wouldn't even decode into the method's args are reported as failing validation
+	client.CallWithTimeout("$device/1/channel/light", "Where", 42, &reply, time.Second)
+	if reply != "Method Where on $device/+/channel/+ failed validation of its params: Not acceptable" {
+		t.Errorf("Unexpected reply to params of the wrong type: %s", reply)
+	}
+
+	// Methods that take no params are validated too
+	client.CallWithTimeout("$device/1/channel/light", "Fast", "bad", &reply, time.Second)
+	if reply != "Method Fast on $device/+/channel/+ failed validation of its params: Not acceptable" {
+		t.Errorf("Unexpected reply to bad params for a method without any: %s", reply)
+	}
+
+	// Params that can't be read at all (testServerCodec can't read a request without any) fail too,
+	// rather than skipping validation
+	memory, _ := bus.ConnectMemoryBus(t.Name()+"-unreadable", "server")
+	_, _, cleanup2 := newTestServerOn(t, memory, &plainBus{memory}, &blockingService{}, "service", nil)
+	defer cleanup2()
+
+	replies := sendRaw(t, memory, `{"id":"caller-1","method":"Fast"}`)
+	select {
+	case payload := <-replies:
+		if !strings.Contains(payload, "Method Fast on service failed validation of its params: unexpected end of JSON input") {
+			t.Errorf("Unexpected reply to params that can't be read: %s", payload)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("No reply to params that can't be read")
+	}
+}
+
+func TestServeBatch(t *testing.T) {
+	_, client, cleanup := newTestServer(t, &blockingService{}, "$device/+/channel/+", nil)
+	defer cleanup()
+
+	batch := client.NewBatch("$device/1/channel/light")
+	var fast, where string
+	fastCall := batch.Add("Fast", nil, &fast)
+	whereCall := batch.Add("Where", "hi", &where)
+
+	if err := batch.Send(context.Background()); err != nil {
+		t.Fatalf("Batch failed: %s", err)
+	}
+	if fastCall.Error != nil || fast != "fast" || whereCall.Error != nil || where != "hi from $device/1/channel/light" {
+		t.Errorf("Unexpected replies: %s (%v), %s (%v)", fast, fastCall.Error, where, whereCall.Error)
+	}
+}
+
+func TestBadBatchIsAnswered(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	_, _, cleanup := newTestServerOn(t, memory, &plainBus{memory}, &blockingService{}, "service", nil)
+	defer cleanup()
+
+	replies := sendRaw(t, memory, `[{"id":"1","method":"Fast"},`)
+	select {
+	case payload := <-replies:
+		if !strings.Contains(payload, "unexpected end of JSON input") {
+			t.Errorf("Expected the batch's error, got %s", payload)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("No reply to a batch that couldn't be read")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	service := &blockingService{release: make(chan bool)}
+	_, client, cleanup := newTestServer(t, service, "service", nil)
+	defer cleanup()
+
+	var seqs, values []int
+	var reply string
+	err := client.CallContextWithProgress(context.Background(), "service", "Update", 5, &reply, func(progress *Progress) {
+		var value int
+		if err := progress.Decode(&value); err != nil {
+			t.Errorf("Failed to decode progress: %s", err)
+		}
+		seqs = append(seqs, progress.Seq)
+		values = append(values, value)
+		if progress.Seq == 1 {
+			service.release <- true
+		}
+	})
+	if err != nil || reply != "updated" {
+		t.Fatalf("Call failed: %s %s", reply, err)
+	}
+
+	// Later updates may be skipped if they are handled after the reply, but never reordered
+	if len(seqs) == 0 || seqs[0] != 1 || values[0] != 10 {
+		t.Fatalf("Expected the first update before the reply, got %v %v", seqs, values)
+	}
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] <= seqs[i-1] || values[i] != seqs[i]*10 {
+			t.Errorf("Updates out of order: %v %v", seqs, values)
+		}
+	}
+
+	if err := SendProgress(service.ctx, 60); err == nil {
+		t.Errorf("Expected progress to be refused once the method returned")
+	}
+	if err := SendProgress(context.Background(), 60); err == nil {
+		t.Errorf("Expected progress to be refused without a method's context")
+	}
+}
+
+// lossyBus loses the first reply published through it, as a reconnecting bus might
+type lossyBus struct {
+	bus.Bus
+	lost int32
+}
+
+func (b *lossyBus) Publish(topic string, payload []byte) {
+	if strings.HasSuffix(topic, "/reply") && atomic.AddInt32(&b.lost, 1) == 1 {
+		return
+	}
+	b.Bus.Publish(topic, payload)
+}
+
+func TestRetriedCallIsServedOnce(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	service := &blockingService{}
+	_, client, cleanup := newTestServerOn(t, memory, &lossyBus{Bus: memory}, service, "service", nil)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	var toggles int
+	err := client.CallContextWithRetry(ctx, "service", "Toggle", nil, &toggles, &RetryPolicy{
+		MaxAttempts:    3,
+		AttemptTimeout: time.Millisecond * 200,
+		Backoff:        time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Retried call failed: %s", err)
+	}
+
+	// The retry got the first attempt's reply, and the method wasn't called again
+	if toggles != 1 || service.toggles != 1 {
+		t.Errorf("Expected a single toggle, the reply said %d and the service %d", toggles, service.toggles)
+	}
+
+	// Without retries, the lost reply is a timeout
+	memory2, _ := bus.ConnectMemoryBus(t.Name()+"-2", "server")
+	_, client, cleanup2 := newTestServerOn(t, memory2, &lossyBus{Bus: memory2}, &blockingService{}, "service", nil)
+	defer cleanup2()
+
+	if err := client.CallContextWithRetry(ctx, "service", "Toggle", nil, &toggles, &RetryPolicy{AttemptTimeout: time.Millisecond * 100}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a timeout without retries, got %v", err)
+	}
+}
+
+func TestRetryAfterBusyIsServedAgain(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	service := &blockingService{}
+	_, _, cleanup := newTestServerOn(t, memory, &plainBus{memory}, service, "service", nil)
+	defer cleanup()
+	client := NewClient(&plainBus{memory}, &codedClientCodec{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	var busy int
+	err := client.CallContextWithRetry(ctx, "service", "Busy", nil, &busy, &RetryPolicy{
+		MaxAttempts:    3,
+		Backoff:        time.Millisecond,
+		RetryableCodes: []ErrorCode{E_BUSY},
+	})
+	if err != nil {
+		t.Fatalf("Retried call failed: %s", err)
+	}
+	if busy != 2 {
+		t.Errorf("Expected the retry to call the method again, it was called %d times", busy)
+	}
+}
+
+// sendRaw publishes requests to a test server as other clients would, and returns the replies
+func sendRaw(t *testing.T, memory *bus.MemoryBus, requests ...string) <-chan string {
+	replies := make(chan string, len(requests))
+	if _, err := memory.Subscribe("service/reply", func(topic string, payload []byte) {
+		replies <- string(payload)
+	}); err != nil {
+		t.Fatalf("Failed to subscribe to the replies: %s", err)
+	}
+	for _, request := range requests {
+		memory.Publish("service", []byte(request))
+	}
+	return replies
+}
+
+func TestDuplicatesNeedTheSameCaller(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	service := &blockingService{}
+	_, _, cleanup := newTestServerOn(t, memory, &plainBus{memory}, service, "service", nil)
+	defer cleanup()
+
+	// Ids that don't say who sent them, as two clients counting from 1 would send
+	replies := sendRaw(t, memory, `{"id":"1","method":"Toggle"}`, `{"id":"1","method":"Toggle"}`)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-replies:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Timed out waiting for reply %d", i+1)
+		}
+	}
+
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.toggles != 2 {
+		t.Errorf("Expected both callers to be served, the method was called %d times", service.toggles)
+	}
+}
+
+func TestDuplicatesDoNotHoldWorkers(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	service := &blockingService{started: make(chan bool, 1), release: make(chan bool)}
+	server, client, cleanup := newTestServerOn(t, memory, &plainBus{memory}, service, "service", nil)
+	defer cleanup()
+
+	// More copies of a call still being served than there are workers
+	requests := make([]string, 20)
+	for i := range requests {
+		requests[i] = `{"id":"caller-1","method":"Slow"}`
+	}
+	replies := sendRaw(t, memory, requests...)
+	<-service.started
+
+	var reply string
+	if err := client.CallWithTimeout("service", "Fast", nil, &reply, time.Second); err != nil {
+		t.Fatalf("Fast call was held up by the duplicates: %s, %+v", err, server.Stats())
+	}
+
+	if payload := <-replies; !strings.Contains(payload, `"fast"`) {
+		t.Fatalf("Expected the fast reply first, got %s", payload)
+	}
+
+	close(service.release)
+	for i := range requests {
+		select {
+		case payload := <-replies:
+			if !strings.Contains(payload, `"slow"`) {
+				t.Errorf("Expected the slow reply, got %s", payload)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Timed out waiting for reply %d", i+1)
+		}
+	}
+}
+
+func TestDuplicateGetsTheReplyAsSent(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	service := &blockingService{shared: []string{"before"}}
+	_, _, cleanup := newTestServerOn(t, memory, &plainBus{memory}, service, "service", nil)
+	defer cleanup()
+
+	replies := sendRaw(t, memory, `{"id":"caller-1","method":"Shared"}`)
+	if payload := <-replies; !strings.Contains(payload, `["before"]`) {
+		t.Fatalf("Unexpected reply: %s", payload)
+	}
+
+	// The method changes what it replied with, after replying
+	service.shared[0] = "after"
+
+	memory.Publish("service", []byte(`{"id":"caller-1","method":"Shared"}`))
+	select {
+	case payload := <-replies:
+		if !strings.Contains(payload, `["before"]`) {
+			t.Errorf("Expected the duplicate to get the reply as it was sent, got %s", payload)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Timed out waiting for the duplicate's reply")
+	}
+}
+
+func TestDedupCacheSize(t *testing.T) {
+	cache := newDedupCache(time.Minute, 2)
+	for _, key := range []string{"a", "b", "c"} {
+		if _, duplicate := cache.start(key); duplicate {
+			t.Errorf("%s isn't a duplicate", key)
+		}
+	}
+	if len(cache.entries) != 2 || len(cache.order) != 2 {
+		t.Errorf("Expected only 2 requests to be remembered, there are %d", len(cache.entries))
+	}
+
+	// The oldest was forgotten to make room
+	if _, duplicate := cache.start("c"); !duplicate {
+		t.Errorf("Expected the latest to be remembered")
+	}
+	if _, duplicate := cache.start("a"); duplicate {
+		t.Errorf("Expected the oldest to be forgotten")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	policy := &RetryPolicy{RetryableCodes: []ErrorCode{E_BUSY}}
+
+	for err, retryable := range map[error]bool{
+		&TimeoutError{}:                         true,
+		fmt.Errorf("Light: %w", ErrBusy):        true,
+		ErrOffline:                              false,
+		fmt.Errorf("Something else went wrong"): false,
+	} {
+		if policy.retryable(err) != retryable {
+			t.Errorf("Expected retryable(%v) to be %t", err, retryable)
+		}
+	}
+
+	for attempt := 1; attempt < 10; attempt++ {
+		if delay := policy.backoff(attempt); delay < time.Millisecond*100 || delay > time.Second*5 {
+			t.Errorf("Backoff after attempt %d out of range: %s", attempt, delay)
+		}
+	}
+}
+
+// redisService takes a redis connection
+type redisService struct{}
+
+func (s *redisService) Ping(conn redis.Conn) (*string, error) {
+	reply, err := conn.Do("PING")
+	if err != nil {
+		return nil, err
+	}
+	pong := reply.(string)
+	return &pong, nil
+}
+
+// testRedisConn answers every command with PONG
+type testRedisConn struct {
+	redis.Conn
+}
+
+func (c *testRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return "PONG", nil
+}
+
+func TestServerInterceptors(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	defer memory.Destroy()
+
+	var mutex sync.Mutex
+	var called []string
+	record := func(name string) ServerInterceptor {
+		return func(ctx context.Context, info *ServerInfo, params interface{}, next MethodHandler) (interface{}, error) {
+			mutex.Lock()
+			called = append(called, name+" "+info.Method)
+			mutex.Unlock()
+			return next(ctx, params)
+		}
+	}
+
+	server := NewServer(&plainBus{memory}, &testServerCodec{})
+	server.Use(record("server"))
+	_, err := server.services.register(&blockingService{}, "service", "test-schema", []string{"fast", "where", "toggle"}, nil, []ServerInterceptor{
+		record("service"),
+		func(ctx context.Context, info *ServerInfo, params interface{}, next MethodHandler) (interface{}, error) {
+			switch info.Method {
+			case "Toggle":
+				return nil, NewError(E_NOT_SUPPORTED, "Toggling isn't allowed")
+			case "Where":
+				return next(ctx, "hi")
+			case "Fast":
+				panic("interceptor failed")
+			}
+			return next(ctx, params)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to register service: %s", err)
+	}
+	if err := server.listen("service", server.pool); err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	client := NewClient(&plainBus{memory}, &testClientCodec{})
+
+	// testServerCodec returns errors as the result
+	for method, expected := range map[string]string{
+		"Where":  "hi from service",
+		"Toggle": "Toggling isn't allowed",
+		"Fast":   "Method Fast on service panicked: interceptor failed",
+	} {
+		called = nil
+
+		var reply string
+		if err := client.CallWithTimeout("service", method, "hello", &reply, time.Second); err != nil {
+			t.Fatalf("Call to %s failed: %s", method, err)
+		}
+		if reply != expected {
+			t.Errorf("Unexpected reply from %s: %s", method, reply)
+		}
+		if strings.Join(called, ",") != "server "+method+",service "+method {
+			t.Errorf("Interceptors called out of order: %v", called)
+		}
+	}
+}
+
+func TestRedisConnFromContext(t *testing.T) {
+	memory, _ := bus.ConnectMemoryBus(t.Name(), "server")
+	defer memory.Destroy()
+
+	server := NewServer(&plainBus{memory}, &testServerCodec{})
+	if _, err := server.services.register(&redisService{}, "service", "test-schema", []string{"ping"}, nil, nil); err != nil {
+		t.Fatalf("Failed to register service: %s", err)
+	}
+	if err := server.listen("service", server.pool); err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	client := NewClient(&plainBus{memory}, &testClientCodec{})
+
+	// Without a pool or an interceptor giving it one, the method can't be called
+	var reply string
+	if err := client.CallWithTimeout("service", "Ping", nil, &reply, time.Second); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	if !strings.Contains(reply, "must set the pool") {
+		t.Errorf("Expected the call to fail without a connection, got %s", reply)
+	}
+
+	server.Use(func(ctx context.Context, info *ServerInfo, params interface{}, next MethodHandler) (interface{}, error) {
+		return next(context.WithValue(ctx, redisConnKey{}, &testRedisConn{}), params)
+	})
+	if err := client.CallWithTimeout("service", "Ping", nil, &reply, time.Second); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	if reply != "PONG" {
+		t.Errorf("Expected the connection from the context to be used, got %s", reply)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	_, client, cleanup := newTestServer(t, &blockingService{}, "service", nil)
+	defer cleanup()
+
+	var calls int32
+	client.Use(func(ctx context.Context, call *Call, next Invoker) error {
+		atomic.AddInt32(&calls, 1)
+		if call.ServiceMethod == "Toggle" {
+			return NewError(E_NOT_SUPPORTED, "Toggling isn't allowed")
+		}
+		return next(ctx, call)
+	})
+
+	var reply string
+	if err := client.CallWithTimeout("service", "Fast", nil, &reply, time.Second); err != nil || reply != "fast" {
+		t.Errorf("Unexpected result of a synchronous call: %q, %v", reply, err)
+	}
+
+	if err := client.Call("service", "Fast", nil); err != nil {
+		t.Errorf("Asynchronous call failed: %s", err)
+	}
+
+	var toggles int
+	if err := client.CallWithTimeout("service", "Toggle", nil, &toggles, time.Second); !IsCode(err, E_NOT_SUPPORTED) {
+		t.Errorf("Expected the interceptor to refuse the call, got %v", err)
+	}
+
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("Expected 3 calls to be intercepted, got %d", calls)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Service is a service schema to generate a client and server interface for
+type Service struct {
+	Name string // The Go name, e.g. OnOff
+	URI  string // e.g. /protocol/on-off
+}
+
+// generator writes Go code for services, using their schemas as the schemas package would load them
+type generator struct {
+	// getDocument returns the (resolved) schema document at a URI
+	getDocument func(uri string) (map[string]interface{}, error)
+	// types are Go types to use for schema fragments, instead of generating them, e.g.
+	// "/protocol/color#/methods/set/params" => "*channels.ColorState"
+	types map[string]string
+
+	code     bytes.Buffer
+	structs  map[string]string // The name of the struct declared for each schema, by URI
+	declared map[string]bool   // The names of the structs declared
+}
+
+// generate returns the source of a file in package pkg, holding a client and a server interface for
+// each service. imports are added for the packages of any types given.
+func (g *generator) generate(pkg string, imports []string, services []Service) ([]byte, error) {
+	g.structs = make(map[string]string)
+	g.declared = make(map[string]bool)
+
+	for _, service := range services {
+		if err := g.service(service); err != nil {
+			return nil, fmt.Errorf("Failed to generate %s: %s", service.URI, err)
+		}
+	}
+
+	var file bytes.Buffer
+	fmt.Fprintf(&file, "// Code generated by rpcgen. DO NOT EDIT.\n\npackage %s\n\nimport (\n\t\"context\"\n\n", pkg)
+	for _, importPath := range append([]string{"github.com/ninjasphere/go-ninja/rpc"}, imports...) {
+		fmt.Fprintf(&file, "\t%q\n", importPath)
+	}
+	fmt.Fprintf(&file, ")\n")
+	file.Write(g.code.Bytes())
+
+	return format.Source(file.Bytes())
+}
+
+// method is a method in a service's schema
+type method struct {
+	name        string // As in the schema, e.g. turnOn
+	goName      string
+	description string
+	params      string // The Go type of the params, "" if there are none
+	reply       string // The Go type of the reply, "" if there is none
+}
+
+func (g *generator) service(service Service) error {
+	doc, err := g.getDocument(service.URI)
+	if err != nil {
+		return err
+	}
+
+	schemaMethods, _ := doc["methods"].(map[string]interface{})
+
+	var names []string
+	for name := range schemaMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var methods []method
+	for _, name := range names {
+		spec, _ := schemaMethods[name].(map[string]interface{})
+		m := method{
+			name:   name,
+			goName: exportedName(name),
+		}
+		m.description, _ = spec["description"].(string)
+
+		base := service.URI + "#/methods/" + name
+		if params, ok := spec["params"].(map[string]interface{}); ok {
+			if m.params, err = g.goType(base+"/params", params, service.Name+m.goName+"Params"); err != nil {
+				return err
+			}
+		}
+		if returns, ok := spec["returns"].(map[string]interface{}); ok {
+			if m.reply, err = g.goType(base+"/returns", returns, service.Name+m.goName+"Reply"); err != nil {
+				return err
+			}
+		}
+		methods = append(methods, m)
+	}
+
+	g.client(service, methods)
+	g.server(service, methods)
+	return nil
+}
+
+// client writes a client with a method for each of the service's
+func (g *generator) client(service Service, methods []method) {
+	fmt.Fprintf(&g.code, "\n// %sClient calls the methods of a %s service\n", service.Name, service.URI)
+	fmt.Fprintf(&g.code, "type %sClient struct {\n\tService rpc.ServiceCaller\n}\n", service.Name)
+
+	for _, m := range methods {
+		fmt.Fprintf(&g.code, "\n")
+		writeDescription(&g.code, m.goName, m.description)
+
+		args := "nil"
+		params := ""
+		if m.params != "" {
+			args = "params"
+			params = ", params " + m.params
+		}
+
+		if m.reply == "" {
+			fmt.Fprintf(&g.code, "func (c *%sClient) %s(ctx context.Context%s) error {\n", service.Name, m.goName, params)
+			fmt.Fprintf(&g.code, "\treturn c.Service.CallContext(ctx, %q, %s, nil)\n}\n", m.name, args)
+			continue
+		}
+
+		fmt.Fprintf(&g.code, "func (c *%sClient) %s(ctx context.Context%s) (%s, error) {\n", service.Name, m.goName, params, m.reply)
+		fmt.Fprintf(&g.code, "\tvar reply %s\n", m.reply)
+		fmt.Fprintf(&g.code, "\terr := c.Service.CallContext(ctx, %q, %s, &reply)\n", m.name, args)
+		fmt.Fprintf(&g.code, "\treturn reply, err\n}\n")
+	}
+}
+
+// server writes an interface with the methods a receiver serving the service must have. Params and
+// replies are pointers, as rpc.Server expects, unless --types gives the params of a method (as a
+// receiver may take them by value).
+func (g *generator) server(service Service, methods []method) {
+	fmt.Fprintf(&g.code, "\n// %sServer is implemented by the receivers of %s services\n", service.Name, service.URI)
+	fmt.Fprintf(&g.code, "type %sServer interface {\n", service.Name)
+
+	for _, m := range methods {
+		writeDescription(&g.code, m.goName, m.description)
+
+		params := ""
+		if _, given := g.types[service.URI+"#/methods/"+m.name+"/params"]; given {
+			params = "params " + m.params
+		} else if m.params != "" {
+			params = "params " + pointer(m.params)
+		}
+
+		if m.reply == "" {
+			fmt.Fprintf(&g.code, "\t%s(%s) error\n", m.goName, params)
+		} else {
+			fmt.Fprintf(&g.code, "\t%s(%s) (%s, error)\n", m.goName, params, pointer(m.reply))
+		}
+	}
+
+	fmt.Fprintf(&g.code, "}\n")
+}
+
+// goType returns the Go type for a schema, declaring a struct called name for it if it is an object
+// with properties. uri is where the schema is, so its refs can be resolved.
+func (g *generator) goType(uri string, schema map[string]interface{}, name string) (string, error) {
+	if goType, ok := g.types[uri]; ok {
+		return goType, nil
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		refURI, err := resolveRef(uri, ref)
+		if err != nil {
+			return "", err
+		}
+		doc, err := g.getDocument(refURI)
+		if err != nil {
+			return "", err
+		}
+		return g.goType(refURI, doc, refName(refURI))
+	}
+
+	switch schema["type"] {
+	case "boolean":
+		return "bool", nil
+	case "integer":
+		return "int", nil
+	case "number":
+		return "float64", nil
+	case "string":
+		return "string", nil
+	case "array":
+		items, ok := schema["items"].(map[string]interface{})
+		if !ok {
+			return "[]interface{}", nil
+		}
+		itemType, err := g.goType(uri+"/items", items, name+"Item")
+		if err != nil {
+			return "", err
+		}
+		return "[]" + itemType, nil
+	case "object":
+		if properties, ok := schema["properties"].(map[string]interface{}); ok {
+			return g.declareStruct(uri, schema, properties, name)
+		}
+		return "map[string]interface{}", nil
+	}
+
+	return "interface{}", nil
+}
+
+// declareStruct declares a struct for an object schema (once, however often it is used), and returns
+// a pointer to it
+func (g *generator) declareStruct(uri string, schema map[string]interface{}, properties map[string]interface{}, name string) (string, error) {
+	if declared, ok := g.structs[uri]; ok {
+		return "*" + declared, nil
+	}
+
+	// Another schema may already have the name
+	unique := name
+	for i := 2; g.declared[unique]; i++ {
+		unique = fmt.Sprintf("%s%d", name, i)
+	}
+	name = unique
+	g.declared[name] = true
+	g.structs[uri] = name
+
+	required := make(map[string]bool)
+	if list, ok := schema["required"].([]interface{}); ok {
+		for _, property := range list {
+			if property, ok := property.(string); ok {
+				required[property] = true
+			}
+		}
+	}
+
+	var names []string
+	for property := range properties {
+		names = append(names, property)
+	}
+	sort.Strings(names)
+
+	var fields bytes.Buffer
+	for _, property := range names {
+		propertySchema, _ := properties[property].(map[string]interface{})
+		fieldName := exportedName(property)
+
+		fieldType, err := g.goType(uri+"/properties/"+property, propertySchema, name+fieldName)
+		if err != nil {
+			return "", err
+		}
+
+		tag := property
+		if !required[property] {
+			tag += ",omitempty"
+		}
+
+		description, _ := propertySchema["description"].(string)
+		if description != "" {
+			fmt.Fprintf(&fields, "\t// %s\n", strings.Replace(description, "\n", "\n\t// ", -1))
+		}
+		fmt.Fprintf(&fields, "\t%s %s `json:\"%s\"`\n", fieldName, fieldType, tag)
+	}
+
+	fmt.Fprintf(&g.code, "\n// %s is %s\ntype %s struct {\n%s}\n", name, uri, name, fields.Bytes())
+
+	return "*" + name, nil
+}
+
+// writeDescription writes a method's description as its doc comment, e.g. "Turns the device on" as
+// "TurnOn turns the device on"
+func writeDescription(code *bytes.Buffer, name string, description string) {
+	if description == "" {
+		return
+	}
+	runes := []rune(description)
+	if len(runes) < 2 || !unicode.IsUpper(runes[1]) {
+		runes[0] = unicode.ToLower(runes[0])
+	}
+	fmt.Fprintf(code, "// %s %s\n", name, strings.Replace(string(runes), "\n", "\n// ", -1))
+}
+
+// pointer returns a pointer to a type, unless it is one already (or a slice, map or interface)
+func pointer(goType string) string {
+	for _, prefix := range []string{"*", "[]", "map[", "interface{}"} {
+		if strings.HasPrefix(goType, prefix) {
+			return goType
+		}
+	}
+	return "*" + goType
+}
+
+// resolveRef resolves a $ref found in the schema at uri
+func resolveRef(uri string, ref string) (string, error) {
+	base, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	resolved := base.ResolveReference(refURL)
+	return strings.Replace(resolved.String(), "%2F", "/", -1), nil
+}
+
+// refName is the name of the struct for a referenced schema, made from its document and fragment,
+// e.g. /protocol/color#/definitions/state => ColorState
+func refName(refURI string) string {
+	u, err := url.Parse(refURI)
+	if err != nil {
+		return exportedName(refURI)
+	}
+	name := exportedName(path.Base(u.Path))
+	if fragment := path.Base(u.Fragment); u.Fragment != "" && fragment != "/" {
+		name += exportedName(fragment)
+	}
+	return name
+}
+
+// exportedName turns a schema name (e.g. "on-off" or "turnOn") into an exported Go name
+func exportedName(name string) string {
+	var exported []rune
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		exported = append(exported, r)
+	}
+	if len(exported) == 0 || unicode.IsDigit(exported[0]) {
+		exported = append([]rune("X"), exported...)
+	}
+	return string(exported)
+}
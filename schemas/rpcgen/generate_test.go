@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var testSchemas = map[string]string{
+	"/protocol/on-off": `{
+		"methods": {
+			"turnOn": {"description": "Turns the device on"},
+			"set": {"params": {"type": "boolean"}},
+			"get": {"returns": {"type": "boolean"}}
+		}
+	}`,
+	"/protocol/color": `{
+		"definitions": {
+			"state": {
+				"type": "object",
+				"required": ["mode"],
+				"properties": {
+					"mode": {"type": "string", "description": "hue or temperature"},
+					"hue": {"type": "number"},
+					"presets": {"type": "array", "items": {"type": "object", "properties": {"name": {"type": "string"}}}}
+				}
+			}
+		},
+		"methods": {
+			"set": {"params": {"$ref": "#/definitions/state"}},
+			"get": {"returns": {"$ref": "#/definitions/state"}},
+			"blink": {"params": {"type": "object", "properties": {"times": {"type": "integer"}}}}
+		}
+	}`,
+}
+
+// getTestDocument loads the test schemas, as schemas.GetDocument would the real ones
+func getTestDocument(uri string) (map[string]interface{}, error) {
+	parts := strings.SplitN(uri, "#", 2)
+	source, ok := testSchemas[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("No schema at %s", uri)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(source), &doc); err != nil {
+		return nil, err
+	}
+	if len(parts) == 2 {
+		for _, key := range strings.Split(strings.Trim(parts[1], "/"), "/") {
+			doc = doc[key].(map[string]interface{})
+		}
+	}
+	return doc, nil
+}
+
+func TestGenerate(t *testing.T) {
+	g := &generator{getDocument: getTestDocument}
+
+	code, err := g.generate("protocols", nil, []Service{
+		{Name: "OnOff", URI: "/protocol/on-off"},
+		{Name: "Color", URI: "/protocol/color"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate: %s", err)
+	}
+
+	for _, expected := range []string{
+		"package protocols",
+		"type OnOffClient struct {\n\tService rpc.ServiceCaller\n}",
+		"// TurnOn turns the device on\nfunc (c *OnOffClient) TurnOn(ctx context.Context) error {\n\treturn c.Service.CallContext(ctx, \"turnOn\", nil, nil)\n}",
+		"func (c *OnOffClient) Set(ctx context.Context, params bool) error {\n\treturn c.Service.CallContext(ctx, \"set\", params, nil)\n}",
+		"func (c *OnOffClient) Get(ctx context.Context) (bool, error) {\n\tvar reply bool\n\terr := c.Service.CallContext(ctx, \"get\", nil, &reply)\n\treturn reply, err\n}",
+		"type OnOffServer interface {\n\tGet() (*bool, error)\n\tSet(params *bool) error\n\t// TurnOn turns the device on\n\tTurnOn() error\n}",
+		"type ColorState struct {\n\tHue float64 `json:\"hue,omitempty\"`\n\t// hue or temperature\n\tMode    string                   `json:\"mode\"`\n\tPresets []*ColorStatePresetsItem `json:\"presets,omitempty\"`\n}",
+		"type ColorStatePresetsItem struct {\n\tName string `json:\"name,omitempty\"`\n}",
+		"type ColorBlinkParams struct {\n\tTimes int `json:\"times,omitempty\"`\n}",
+		"func (c *ColorClient) Get(ctx context.Context) (*ColorState, error) {",
+		"type ColorServer interface {\n\tBlink(params *ColorBlinkParams) error\n\tGet() (*ColorState, error)\n\tSet(params *ColorState) error\n}",
+	} {
+		if !strings.Contains(string(code), expected) {
+			t.Errorf("Expected the code to contain:\n%s\n\nbut it was:\n%s", expected, code)
+		}
+	}
+
+	// The state is used twice, but only declared once
+	if strings.Count(string(code), "type ColorState struct") != 1 {
+		t.Errorf("Expected ColorState to be declared once")
+	}
+}
+
+func TestGenerateWithTypes(t *testing.T) {
+	g := &generator{
+		getDocument: getTestDocument,
+		types: map[string]string{
+			"/protocol/color#/definitions/state":    "*channels.ColorState",
+			"/protocol/color#/methods/blink/params": "int",
+		},
+	}
+
+	code, err := g.generate("protocols", []string{"github.com/ninjasphere/go-ninja/channels"}, []Service{
+		{Name: "Color", URI: "/protocol/color"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate: %s", err)
+	}
+
+	if !strings.Contains(string(code), "\t\"github.com/ninjasphere/go-ninja/channels\"\n") ||
+		!strings.Contains(string(code), "\tSet(params *channels.ColorState) error\n") ||
+		!strings.Contains(string(code), "\tBlink(params int) error\n") ||
+		strings.Contains(string(code), "type ColorState struct") {
+		t.Errorf("Expected the given type to be used for the state:\n%s", code)
+	}
+}
+
+func TestExportedName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"on-off":       "OnOff",
+		"turnOn":       "TurnOn",
+		"3phase-power": "X3phasePower",
+		"media_url":    "MediaUrl",
+	} {
+		if exported := exportedName(name); exported != expected {
+			t.Errorf("Expected %s to be %s, got %s", name, expected, exported)
+		}
+	}
+}
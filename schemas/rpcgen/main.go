@@ -0,0 +1,95 @@
+// rpcgen generates typed clients for services from their schemas, and interfaces their receivers can
+// be checked against at compile time. It takes its options as any module does (see the config package):
+//
+//	rpcgen --package protocols --out protocols/generated.go \
+//	  --schemas /protocol/on-off,/protocol/color \
+//	  --types '/protocol/color#/methods/set/params=*channels.ColorState' \
+//	  --imports github.com/ninjasphere/go-ninja/channels
+//
+// For each schema it writes a client (e.g. OnOffClient, whose TurnOn(ctx) calls turnOn) and a server
+// interface (e.g. OnOffServer), so a receiver can be checked with
+//
+//	var _ protocols.OnOffServer = (*channels.OnOffChannel)(nil)
+//
+// A method's params and returns are each a JSON schema for a single value, as rpc.Server validates
+// them. Objects with properties get a struct of their own, unless --types says which Go type to use
+// for them (comma separated fragment=type pairs). A type given for a method's params is used as is in
+// the server interface, e.g. float64 for a receiver that takes them by value. A schema can be given a Go name other than the one
+// made from its URI with Name=/its/uri.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/go-ninja/schemas"
+)
+
+func main() {
+	var services []Service
+	for _, spec := range list(config.String("", "schemas")) {
+		service := Service{URI: spec}
+		if i := strings.Index(spec, "="); i >= 0 {
+			service = Service{Name: spec[:i], URI: spec[i+1:]}
+		}
+		if service.Name == "" {
+			service.Name = exportedName(path.Base(service.URI))
+		}
+		services = append(services, service)
+	}
+
+	if len(services) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: rpcgen --package name --schemas /protocol/on-off,... [--out file] [--types fragment=type,...] [--imports path,...]\n")
+		os.Exit(2)
+	}
+
+	types := make(map[string]string)
+	for _, pair := range list(config.String("", "types")) {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			fatalf("Types must be given as fragment=type, not %s", pair)
+		}
+		types[pair[:i]] = pair[i+1:]
+	}
+
+	g := &generator{
+		getDocument: func(uri string) (map[string]interface{}, error) {
+			return schemas.GetDocument(uri, true)
+		},
+		types: types,
+	}
+
+	code, err := g.generate(config.String("protocols", "package"), list(config.String("", "imports")), services)
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	if out := config.String("", "out"); out != "" {
+		err = ioutil.WriteFile(out, code, 0644)
+	} else {
+		_, err = os.Stdout.Write(code)
+	}
+	if err != nil {
+		fatalf("Failed to write the generated code: %s", err)
+	}
+}
+
+// list splits a comma separated option
+func list(option string) []string {
+	var items []string
+	for _, item := range strings.Split(option, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "rpcgen: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/ninjasphere/go-ninja/config"
@@ -34,6 +35,11 @@ func init() {
 	}
 }
 
+// ValidationEnabled returns true if payloads are being validated (config key "validate")
+func ValidationEnabled() bool {
+	return validationEnabled
+}
+
 func Validate(schema string, obj interface{}) (*string, error) {
 
 	if !validationEnabled {
@@ -278,6 +284,7 @@ type schemaResponse struct {
 }
 
 var schemasCache = make(map[string]schemaResponse)
+var schemasCacheMutex sync.Mutex
 
 func GetSchema(documentURL string) (*gojsonschema.JsonSchemaDocument, error) {
 
@@ -288,6 +295,9 @@ func GetSchema(documentURL string) (*gojsonschema.JsonSchemaDocument, error) {
 	localRef := useLocalUrl(resolved)
 	local := localRef.GetUrl().String()
 
+	schemasCacheMutex.Lock()
+	defer schemasCacheMutex.Unlock()
+
 	schema, ok := schemasCache[local]
 	if !ok {
 		log.Debugf("Cache miss on '%s'", resolved.GetUrl().String())